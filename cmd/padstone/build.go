@@ -3,20 +3,37 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/apparentlymart/padstone/padstone"
 
+	getter "github.com/hashicorp/go-getter"
 	tfcmd "github.com/hashicorp/terraform/command"
-	tfmodcfg "github.com/hashicorp/terraform/config/module"
 	"github.com/hashicorp/terraform/terraform"
 )
 
 type BuildCommand struct {
-	ui    *UI
-	input *tfcmd.UIInput
+	ui      *UI
+	input   *tfcmd.UIInput
+	journal *os.File
 
-	Verbose bool             `short:"v" long:"verbose" description:"show detailed information about resources"`
-	Args    BuildCommandArgs `positional-args:"true" required:"true"`
+	Verbose            bool             `short:"v" long:"verbose" description:"show detailed information about resources"`
+	Dev                bool             `long:"dev" description:"keep the configuration's default development targets rather than its default build targets"`
+	Targets            []string         `short:"t" long:"target" description:"name of a target to keep, building any targets it depends on as temporary targets; may be repeated"`
+	Parallelism        int              `long:"parallelism" default:"10" description:"maximum number of targets that do not depend on one another to build at once"`
+	Plan               string           `long:"plan" description:"path to a plan file saved by 'padstone plan', to build exactly what was planned"`
+	Resume             string           `long:"resume" description:"path to the state file of an earlier build that failed, to continue from where it stopped"`
+	OnFailure          string           `long:"on-failure" choice:"destroy" choice:"keep" choice:"ask" description:"what to do with the resources already created if the build fails; use 'keep' to allow resuming it with --resume (default: destroy, or keep with --keep-temporary)"`
+	KeepTemporary      bool             `long:"keep-temporary" description:"keep the temporary targets rather than destroying them, recording them in a separate state file for 'padstone cleanup'"`
+	PauseBeforeCleanup bool             `long:"pause-before-cleanup" description:"wait for confirmation before destroying temporary resources"`
+	TTL                time.Duration    `long:"ttl" description:"how long the build is kept before 'padstone gc' may destroy it, such as 72h (default: the configuration's build_ttl, if any)"`
+	Protect            bool             `long:"protect" description:"mark the build as protected, so that 'padstone gc' never destroys it"`
+	Labels             []string         `long:"label" value-name:"KEY=VALUE" description:"a label to record in the build's metadata, for finding it later; may be repeated"`
+	Args               BuildCommandArgs `positional-args:"true" required:"true"`
 }
 
 type BuildCommandArgs struct {
@@ -34,19 +51,103 @@ func (c *BuildCommand) Execute(args []string) error {
 		return err
 	}
 
-	storage := &tfmodcfg.FolderStorage{
+	if err := checkConfig(c.ui, config); err != nil {
+		return err
+	}
+
+	var savedPlan *padstone.Plan
+	var targets []string
+	if c.Plan != "" {
+		if c.Dev {
+			return fmt.Errorf("--dev cannot be used with --plan, since the plan already selects its targets")
+		}
+		if len(c.Args.VarSpecs) > 0 {
+			return fmt.Errorf("variables cannot be set with --plan, since the plan already includes them")
+		}
+		if c.Resume != "" {
+			return fmt.Errorf("--resume cannot be used with --plan")
+		}
+		if len(c.Targets) > 0 {
+			return fmt.Errorf("--target cannot be used with --plan, since the plan already selects its targets")
+		}
+
+		savedPlan, err = readPlanFile(c.Plan)
+		if err != nil {
+			return err
+		}
+		targets = savedPlan.Targets
+	} else {
+		targets, err = selectedTargets(config, c.Targets, c.Dev)
+		if err != nil {
+			return err
+		}
+	}
+
+	graph, err := config.TargetGraph()
+	if err != nil {
+		return err
+	}
+
+	selection, err := graph.Select(targets)
+	if err != nil {
+		return err
+	}
+
+	c.ui.Info(fmt.Sprintf("Targets to keep: %s", strings.Join(selection.Kept, ", ")))
+	if len(selection.Temporary) > 0 {
+		c.ui.Info(fmt.Sprintf("Temporary targets: %s", strings.Join(selection.Temporary, ", ")))
+	}
+
+	storage := &getter.FolderStorage{
 		StorageDir: ".padstone",
 	}
 
 	// The state file must not already exist, since we don't to
 	// accidentally clobber the record of resources created in an
-	// earlier build.
-	_, err = os.Lstat(c.Args.StateFile)
-	if err == nil {
-		return fmt.Errorf("state file %s already exists; specify a different name or destroy it with 'padstone destroy' before generating a new set of resources", c.Args.StateFile)
+	// earlier build. The exception is when resuming a build, which
+	// may write to the state file it resumes from.
+	if c.Resume == "" || c.Resume != c.Args.StateFile {
+		_, err = os.Lstat(c.Args.StateFile)
+		if err == nil {
+			return fmt.Errorf("state file %s already exists; specify a different name or destroy it with 'padstone destroy' before generating a new set of resources", c.Args.StateFile)
+		}
+
+		journalFile := journalFilename(c.Args.StateFile)
+		_, err = os.Lstat(journalFile)
+		if err == nil {
+			return fmt.Errorf("journal %s already exists, so an earlier build may have been killed; run 'padstone recover %s' to recover its state", journalFile, journalFile)
+		}
+	}
+
+	for _, tempFile := range []string{temporaryStateFilename(c.Args.StateFile), leftoversStateFilename(c.Args.StateFile)} {
+		_, err = os.Lstat(tempFile)
+		if err == nil {
+			return fmt.Errorf("state file %s already exists; destroy its resources with 'padstone cleanup' before starting a new build", tempFile)
+		}
 	}
 
 	state := terraform.NewState()
+	if c.Resume != "" {
+		if len(c.Labels) > 0 {
+			return fmt.Errorf("--label cannot be used with --resume, since the build already has its labels")
+		}
+
+		state, err = ReadStateFile(c.Resume)
+		if err != nil {
+			return err
+		}
+		c.ui.Info(fmt.Sprintf("Resuming the build recorded in %s", c.Resume))
+	} else {
+		meta, err := c.buildMetadata(config)
+		if err != nil {
+			return err
+		}
+		err = padstone.SetStateMetadata(state, meta)
+		if err != nil {
+			return err
+		}
+		c.ui.Info(fmt.Sprintf("Build ID: %s", meta.BuildID))
+	}
 
 	uiHook := &UIHook{
 		ui:      c.ui,
@@ -60,9 +161,13 @@ func (c *BuildCommand) Execute(args []string) error {
 	if err != nil {
 		return err
 	}
+	if savedPlan != nil {
+		variables = savedPlan.Variables
+	}
 
 	ctx := &padstone.Context{
 		Config:        config,
+		Targets:       targets,
 		State:         state,
 		Providers:     sysConfig.ProviderFactories(),
 		Provisioners:  sysConfig.ProvisionerFactories(),
@@ -70,44 +175,407 @@ func (c *BuildCommand) Execute(args []string) error {
 		Hooks:         []terraform.Hook{stateHook, uiHook},
 		UIInput:       c.ui,
 		ModuleStorage: storage,
+		Parallelism:   c.Parallelism,
+		SavedPlan:     savedPlan,
 	}
 
-	warns, errs := ctx.Validate()
-	for _, warning := range warns {
-		c.ui.Warn(warning)
+	diags := ctx.Validate()
+	for _, diag := range diags.Warnings() {
+		c.ui.Warn(diag.Error())
 	}
-	if len(errs) > 0 {
-		for _, err := range errs {
-			c.ui.Error(err.Error())
+	if diags.HasErrors() {
+		for _, diag := range diags.Errors() {
+			c.ui.Error(diag.Error())
 		}
 		return fmt.Errorf("aborted due to configuration errors.")
 	}
 
-	err = ctx.Build()
+	// The journal is only opened once nothing else can stop the build
+	// from starting, so that it exists only while resources may be
+	// created that are not yet recorded in the state file.
+	c.journal, err = os.OpenFile(journalFilename(c.Args.StateFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
 	if err != nil {
-		return err
+		return fmt.Errorf("error opening journal: %s", err)
 	}
+	defer c.journal.Close()
+	ctx.Hooks = append([]terraform.Hook{padstone.NewJournalHook(c.journal)}, ctx.Hooks...)
 
-	c.ui.Info("--- Build succeeded! Now destroying temporary resources... ---")
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupts)
+	go c.handleInterrupts(interrupts, ctx, stateHook)
 
-	err = ctx.CleanUp()
+	err = ctx.Build()
+	if padstone.IsInterrupted(err) {
+		// Other targets may have failed before the interrupt arrived, and
+		// their errors would otherwise never be seen.
+		if interruptErr, ok := err.(*padstone.InterruptedError); ok {
+			c.ui.Error(interruptErr.Err.Error())
+		}
+		c.ui.Warn("--- Build interrupted! Now destroying temporary and partially-built resources... ---")
+
+		err = ctx.CleanUp()
+		if err != nil {
+			return c.recordLeftovers(ctx, stateHook, err)
+		}
+		if err := c.saveState(stateHook, ctx.CurrentState()); err != nil {
+			c.ui.Error(err.Error())
+		}
+		return padstone.ErrInterrupted
+	}
 	if err != nil {
-		return err
+		return c.handleFailure(ctx, stateHook, err)
+	}
+
+	switch {
+	case len(selection.Temporary) > 0 && c.KeepTemporary:
+		c.ui.Info("--- Build succeeded! Keeping temporary resources... ---")
+
+		err = c.keepTemporary(ctx)
+		if err != nil {
+			return err
+		}
+	case len(selection.Temporary) > 0:
+		c.ui.Info("--- Build succeeded! ---")
+
+		err = c.pauseBeforeCleanup()
+		if err != nil {
+			return err
+		}
+
+		c.ui.Info("Now destroying temporary resources...")
+		err = ctx.CleanUp()
+		if err != nil {
+			return c.recordLeftovers(ctx, stateHook, err)
+		}
+
+		c.ui.Info(fmt.Sprintf("Destroyed temporary targets: %s", strings.Join(selection.Temporary, ", ")))
+	default:
+		c.ui.Info("--- Build succeeded! ---")
 	}
 
-	_, err = stateHook.PostStateUpdate(ctx.ResultState)
+	err = c.saveState(stateHook, ctx.ResultState)
 	if err != nil {
 		return err
 	}
 
-	outputs := ctx.ResultState.Modules[0].Outputs
+	outputs := ctx.ResultState.RootModule().Outputs
 	if len(outputs) > 0 {
 		c.ui.Output("\nOutputs:")
-		for k, v := range outputs {
-			c.ui.Output(fmt.Sprintf("- %v = %v", k, v))
+		for _, line := range outputLines(outputs) {
+			c.ui.Output(line)
 		}
 		c.ui.Output("")
 	}
 
 	return nil
 }
+
+// buildMetadata returns the metadata to record in the state of a new build.
+func (c *BuildCommand) buildMetadata(config *padstone.Config) (*padstone.BuildMetadata, error) {
+	configPath, err := filepath.Abs(c.Args.ConfigDir)
+	if err != nil {
+		return nil, err
+	}
+
+	configHash, err := padstone.ConfigHash(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	buildID, err := padstone.NewBuildID()
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := decodeKVSpecs(c.Labels)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &padstone.BuildMetadata{
+		BuildID:    buildID,
+		User:       currentUser(),
+		Labels:     labels,
+		ConfigPath: configPath,
+		ConfigHash: configHash,
+		Protected:  c.Protect,
+	}
+
+	// The host name is only informational, so a build can go ahead
+	// without it.
+	meta.Host, _ = os.Hostname()
+
+	ttl := c.TTL
+	if ttl == 0 {
+		ttl = config.BuildTTL
+	}
+	if ttl > 0 {
+		meta.ExpiresAt = time.Now().Add(ttl).UTC()
+		c.ui.Info(fmt.Sprintf("Build expires at %s", meta.ExpiresAt.Format(time.RFC3339)))
+	}
+
+	return meta, nil
+}
+
+// handleFailure deals with the resources left behind by a build that
+// failed with the given error, as directed by the --on-failure option, and
+// returns the error that the command should fail with.
+func (c *BuildCommand) handleFailure(ctx *padstone.Context, stateHook *StateHook, buildErr error) error {
+	state := ctx.CurrentState()
+	if state == nil {
+		if err := c.discardJournal(); err != nil {
+			c.ui.Error(err.Error())
+		}
+		return buildErr
+	}
+	if !padstone.StateHasResources(state) {
+		// Nothing was created, so there is nothing to record. A state file
+		// would only stop the next build from using the same path, so any
+		// that was written while building is removed too, unless it is the
+		// one being resumed.
+		if err := c.discardJournal(); err != nil {
+			c.ui.Error(err.Error())
+		}
+		if c.Resume != c.Args.StateFile {
+			err := os.Remove(c.Args.StateFile)
+			if err != nil && !os.IsNotExist(err) {
+				c.ui.Error(fmt.Sprintf("error removing state file: %s", err))
+			}
+		}
+		return buildErr
+	}
+
+	c.ui.Error(buildErr.Error())
+
+	onFailure := c.OnFailure
+	if onFailure == "" {
+		onFailure = "destroy"
+		if c.KeepTemporary {
+			onFailure = "keep"
+		}
+	}
+
+	destroy := onFailure == "destroy"
+	if onFailure == "ask" {
+		answer, err := c.ui.Input(&terraform.InputOpts{
+			Id:          "on-failure",
+			Query:       "Destroy the resources that were created before the build failed?",
+			Description: "Only 'yes' will destroy them. Otherwise they will be kept, and recorded in the state file for debugging.",
+		})
+		if err != nil {
+			return fmt.Errorf("error asking whether to destroy resources: %s", err)
+		}
+		destroy = answer == "yes"
+	}
+
+	if !destroy {
+		if err := c.saveState(stateHook, state); err != nil {
+			return fmt.Errorf("%s; error saving state: %s", buildErr, err)
+		}
+		c.ui.Warn(fmt.Sprintf("--- Build failed! The resources created so far are recorded in %s; run 'padstone destroy' to destroy them. ---", c.Args.StateFile))
+		return fmt.Errorf("build failed")
+	}
+
+	c.ui.Warn("--- Build failed! ---")
+
+	if err := c.pauseBeforeCleanup(); err != nil {
+		return err
+	}
+
+	c.ui.Warn("Now destroying all resources created so far...")
+
+	cleanUpErr := ctx.CleanUpAll()
+	if err := c.saveState(stateHook, ctx.CurrentState()); err != nil {
+		c.ui.Error(err.Error())
+	}
+	if cleanUpErr != nil {
+		return fmt.Errorf("%s; resources that could not be destroyed remain recorded in %s", cleanUpErr, c.Args.StateFile)
+	}
+
+	c.ui.Info("Destroyed all resources created by the failed build.")
+	return fmt.Errorf("build failed")
+}
+
+// saveState writes the given state to the state file. Once it has been
+// written the state file is a complete record of the build, so the journal
+// is removed; if writing fails, the journal is kept so that 'padstone
+// recover' can still recover the state.
+func (c *BuildCommand) saveState(stateHook *StateHook, state *terraform.State) error {
+	_, err := stateHook.PostStateUpdate(state)
+	if err != nil {
+		return err
+	}
+	return c.discardJournal()
+}
+
+// discardJournal closes and removes the journal, if it is open.
+func (c *BuildCommand) discardJournal() error {
+	if c.journal == nil {
+		return nil
+	}
+	filename := c.journal.Name()
+	c.journal.Close()
+	c.journal = nil
+
+	err := os.Remove(filename)
+	if err != nil {
+		return fmt.Errorf("error removing journal: %s", err)
+	}
+	return nil
+}
+
+// keepTemporary moves the temporary targets out of the result state and
+// into their own state file, for later use with 'padstone cleanup'.
+func (c *BuildCommand) keepTemporary(ctx *padstone.Context) error {
+	tempState, err := ctx.KeepTemporary()
+	if err != nil {
+		return err
+	}
+
+	tempFile := temporaryStateFilename(c.Args.StateFile)
+	err = WriteState(tempState, tempFile)
+	if err != nil {
+		return err
+	}
+
+	names := padstone.StateTargetNames(tempState)
+	c.ui.Warn(fmt.Sprintf(
+		"Temporary targets %s were not destroyed, and are recorded in %s. Run 'padstone cleanup %s' to destroy them.",
+		strings.Join(names, ", "), tempFile, c.Args.StateFile,
+	))
+	return nil
+}
+
+// recordLeftovers moves any temporary targets that could not be destroyed
+// because of the given error out of the result state and into their own
+// "leftovers" state file, for later use with 'padstone cleanup', and warns
+// about each of the resources that remain.
+//
+// Kept targets that were only partially built and could not be destroyed
+// either stay in the result state, since they are destroyed along with the
+// rest of the build, but their resources are listed too.
+func (c *BuildCommand) recordLeftovers(ctx *padstone.Context, stateHook *StateHook, cleanUpErr error) error {
+	c.ui.Error(cleanUpErr.Error())
+
+	leftovers, err := ctx.KeepTemporary()
+	if err != nil {
+		return err
+	}
+	leftoverResources := padstone.StateResources(leftovers)
+
+	if len(leftoverResources) > 0 {
+		leftoversFile := leftoversStateFilename(c.Args.StateFile)
+		err = WriteState(leftovers, leftoversFile)
+		if err != nil {
+			return err
+		}
+
+		c.ui.Warn("The following temporary resources could not be destroyed:")
+		c.warnResources(leftoverResources)
+		c.ui.Warn(fmt.Sprintf(
+			"They are recorded in %s. Run 'padstone cleanup %s' to try again to destroy them.",
+			leftoversFile, c.Args.StateFile,
+		))
+	}
+
+	state := ctx.CurrentState()
+	err = c.saveState(stateHook, state)
+	if err != nil {
+		return err
+	}
+
+	incomplete := make(map[string]bool)
+	for _, name := range ctx.IncompleteTargets() {
+		incomplete[name] = true
+	}
+	var incompleteResources []padstone.StateResource
+	for _, res := range padstone.StateResources(state) {
+		if incomplete[res.Target] {
+			incompleteResources = append(incompleteResources, res)
+		}
+	}
+
+	if len(incompleteResources) > 0 {
+		c.ui.Warn("The following resources of partially-built targets could not be destroyed:")
+		c.warnResources(incompleteResources)
+		c.ui.Warn(fmt.Sprintf(
+			"They remain recorded in %s. Run 'padstone destroy %s' to destroy them along with the rest of the build.",
+			c.Args.StateFile, c.Args.StateFile,
+		))
+	}
+
+	if len(leftoverResources) == 0 && len(incompleteResources) == 0 {
+		return fmt.Errorf("failed to clean up the build")
+	}
+
+	return &exitError{
+		Err:  fmt.Errorf("failed to destroy temporary or partially-built resources"),
+		Code: exitLeakedResources,
+	}
+}
+
+// warnResources warns about each of the given resources, one per line.
+func (c *BuildCommand) warnResources(resources []padstone.StateResource) {
+	for _, res := range resources {
+		id := res.ID
+		if id == "" {
+			id = "(no id)"
+		}
+		c.ui.Warn(fmt.Sprintf("  %s: %s %s", res.Target, res.Address, id))
+	}
+}
+
+// pauseBeforeCleanup waits for confirmation before resources are destroyed,
+// if --pause-before-cleanup was used, so that they can be inspected first.
+func (c *BuildCommand) pauseBeforeCleanup() error {
+	if !c.PauseBeforeCleanup {
+		return nil
+	}
+
+	_, err := c.ui.Input(&terraform.InputOpts{
+		Id:          "pause-before-cleanup",
+		Query:       "Press enter to continue and destroy the resources.",
+		Description: "The build has paused so that its resources can be inspected before they are destroyed.",
+	})
+	if err != nil {
+		return fmt.Errorf("error waiting for confirmation: %s", err)
+	}
+	return nil
+}
+
+// handleInterrupts stops the build when the first interrupt signal arrives,
+// allowing it to clean up after itself. A second signal exits immediately,
+// after saving the state so that anything left behind can be destroyed
+// later.
+func (c *BuildCommand) handleInterrupts(interrupts <-chan os.Signal, ctx *padstone.Context, stateHook *StateHook) {
+	<-interrupts
+	c.ui.Warn("Interrupt received. Waiting for in-progress operations to finish; interrupt again to exit immediately.")
+	ctx.Stop()
+
+	<-interrupts
+	c.ui.Error("Second interrupt received. Exiting without cleaning up.")
+	if state := ctx.CurrentState(); state != nil {
+		if _, err := stateHook.PostStateUpdate(state); err != nil {
+			c.ui.Error(err.Error())
+		} else {
+			c.ui.Error(fmt.Sprintf("Any resources that were created are recorded in %s; run 'padstone destroy' to destroy them.", c.Args.StateFile))
+		}
+	}
+	os.Exit(1)
+}
+
+func readPlanFile(filename string) (*padstone.Plan, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening plan file %s: %s", filename, err)
+	}
+	defer f.Close()
+
+	plan, err := padstone.ReadPlan(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plan file %s: %s", filename, err)
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	tfcmd "github.com/hashicorp/terraform/command"
+)
+
+type CleanupCommand struct {
+	ui    *UI
+	input *tfcmd.UIInput
+
+	Verbose bool               `short:"v" long:"verbose" description:"show detailed information about resources"`
+	Config  string             `short:"c" long:"config" description:"path to the build configuration, used only if the state does not record enough of it"`
+	Args    CleanupCommandArgs `positional-args:"true" required:"true"`
+}
+
+type CleanupCommandArgs struct {
+	StateFile string   `positional-arg-name:"state-file" description:"path to the state file of the build whose temporary resources are to be destroyed"`
+	VarSpecs  []string `positional-args:"true" positional-arg-name:"name=value" description:"zero or more variable values for the configuration, or values for provider settings that the state does not record, such as secrets"`
+}
+
+func (c *CleanupCommand) Execute(args []string) error {
+	sysConfig := BuiltinConfig
+	sysConfig.Discover()
+
+	configPath, stateFile, varSpecs := legacyStateArgs(c.Config, c.Args.StateFile, c.Args.VarSpecs)
+
+	var stateFiles []string
+	for _, filename := range []string{temporaryStateFilename(stateFile), leftoversStateFilename(stateFile)} {
+		if _, err := os.Lstat(filename); err == nil {
+			stateFiles = append(stateFiles, filename)
+		}
+	}
+	if len(stateFiles) == 0 {
+		return fmt.Errorf("there are no temporary resources recorded for %s", stateFile)
+	}
+
+	variables, err := decodeKVSpecs(varSpecs)
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range stateFiles {
+		config, fileVariables, err := destroyConfig(c.ui, filename, configPath, variables)
+		if err != nil {
+			return err
+		}
+
+		_, err = destroyStateFile(c.ui, &sysConfig, config, filename, fileVariables, c.Verbose)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -3,11 +3,13 @@ package main
 import (
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 
 	"github.com/apparentlymart/padstone/padstone"
 
+	getter "github.com/hashicorp/go-getter"
 	tfcmd "github.com/hashicorp/terraform/command"
-	tfmodcfg "github.com/hashicorp/terraform/config/module"
 	"github.com/hashicorp/terraform/terraform"
 )
 
@@ -15,95 +17,196 @@ type DestroyCommand struct {
 	ui    *UI
 	input *tfcmd.UIInput
 
-	Verbose bool             `short:"v" long:"verbose" description:"show detailed information about resources"`
-	Args    BuildCommandArgs `positional-args:"true" required:"true"`
+	Verbose bool               `short:"v" long:"verbose" description:"show detailed information about resources"`
+	Config  string             `short:"c" long:"config" description:"path to the build configuration, used only if the state does not record enough of it"`
+	Args    DestroyCommandArgs `positional-args:"true" required:"true"`
 }
 
 type DestroyCommandArgs struct {
-	ConfigDir string   `positional-arg-name:"config-dir" description:"path to the directory containing the build configuration"`
-	StateFile string   `positional-arg-name:"state-output-file" description:"path where the resulting state file will be written"`
-	VarSpecs  []string `positional-args:"true" positional-arg-name:"varname=value" description:"zero or more explicit variable value specifications"`
+	StateFile string   `positional-arg-name:"state-file" description:"path to the state file of the build to destroy"`
+	VarSpecs  []string `positional-args:"true" positional-arg-name:"name=value" description:"zero or more variable values for the configuration, or values for provider settings that the state does not record, such as secrets"`
 }
 
 func (c *DestroyCommand) Execute(args []string) error {
 	sysConfig := BuiltinConfig
 	sysConfig.Discover()
 
-	config, err := padstone.LoadConfig(c.Args.ConfigDir)
+	configPath, stateFile, varSpecs := legacyStateArgs(c.Config, c.Args.StateFile, c.Args.VarSpecs)
+
+	variables, err := decodeKVSpecs(varSpecs)
 	if err != nil {
 		return err
 	}
 
-	storage := &tfmodcfg.FolderStorage{
-		StorageDir: ".padstone",
+	config, variables, err := destroyConfig(c.ui, stateFile, configPath, variables)
+	if err != nil {
+		return err
 	}
 
-	stateFile, err := os.Open(c.Args.StateFile)
+	destroyed, err := destroyStateFile(c.ui, &sysConfig, config, stateFile, variables, c.Verbose)
 	if err != nil {
-		return fmt.Errorf("error opening state file %s: %s", c.Args.StateFile, err)
+		return err
+	}
+
+	if destroyed {
+		// A journal left by a build that failed is of no further use.
+		err = os.Remove(journalFilename(stateFile))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed to remove journal %s: %s", journalFilename(stateFile), err)
+		}
 	}
 
-	state, err := terraform.ReadState(stateFile)
+	return nil
+}
+
+// destroyConfig returns the configuration and variables to use to destroy
+// the resources recorded in the given state file.
+//
+// The configuration snapshot recorded in the state is preferred, since it
+// is exactly what the resources were built with. The configuration at
+// configPath is loaded only if the snapshot is not sufficient, and if
+// configPath is empty that is an error.
+func destroyConfig(ui *UI, filename, configPath string, variables map[string]string) (*padstone.Config, map[string]string, error) {
+	state, err := ReadStateFile(filename)
 	if err != nil {
-		return fmt.Errorf("error reading state file %s: %s", c.Args.StateFile, err)
+		return nil, nil, err
 	}
 
-	uiHook := &UIHook{
-		ui:      c.ui,
-		verbose: c.Verbose,
+	meta, err := padstone.StateMetadata(state)
+	if err != nil {
+		return nil, nil, err
 	}
-	stateHook := &StateHook{
-		OutputFilename: c.Args.StateFile,
+
+	var reason error
+	if meta.Snapshot == nil {
+		reason = fmt.Errorf("it does not record the configuration it was built with")
+	} else {
+		config, err := meta.Snapshot.Config(padstone.StateTargetNames(state), variables)
+		if err == nil {
+			// The given values can only fill in the provider settings that
+			// were not recorded, since everything else is already known.
+			used := make(map[string]bool)
+			for _, target := range meta.Snapshot.Targets {
+				for _, provider := range target.Providers {
+					var missing []string
+					for _, name := range provider.Omitted {
+						if _, ok := provider.Setting(variables, name); !ok {
+							missing = append(missing, name)
+						}
+						used[name] = true
+						used[provider.FullName()+"."+name] = true
+					}
+					if len(missing) > 0 {
+						ui.Info(fmt.Sprintf(
+							"The %s provider of target %s may need these settings, which were not recorded, from the environment or as NAME=value arguments: %s",
+							provider.FullName(), target.Name, strings.Join(missing, ", "),
+						))
+					}
+				}
+			}
+			var unused []string
+			for k := range variables {
+				if !used[k] {
+					unused = append(unused, k)
+				}
+			}
+			sort.Strings(unused)
+			for _, k := range unused {
+				ui.Warn(fmt.Sprintf(
+					"%s is not a provider setting that is missing from the configuration recorded in %s, and will be ignored.",
+					k, filename,
+				))
+			}
+			return config, nil, nil
+		}
+		reason = err
+	}
+
+	if configPath == "" {
+		return nil, nil, fmt.Errorf(
+			"%s cannot be destroyed from its state alone, because %s; give the configuration it was built from with --config",
+			filename, reason,
+		)
 	}
 
-	variables, err := decodeKVSpecs(c.Args.VarSpecs)
+	config, err := padstone.LoadConfig(configPath)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+
+	if meta.ConfigHash != "" {
+		hash, err := padstone.ConfigHash(configPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		if hash != meta.ConfigHash {
+			ui.Warn(fmt.Sprintf("The configuration at %s has changed since %s was built.", configPath, filename))
+		}
+	}
+
+	return config, variables, nil
+}
+
+// destroyStateFile destroys the resources recorded in the given state file
+// using the given configuration, as returned by destroyConfig. If they are
+// all destroyed the file is removed and the result is true, and otherwise
+// the file is updated to record the resources that remain.
+func destroyStateFile(ui *UI, sysConfig *Config, config *padstone.Config, filename string, variables map[string]string, verbose bool) (bool, error) {
+	storage := &getter.FolderStorage{
+		StorageDir: ".padstone",
+	}
+
+	state, err := ReadStateFile(filename)
+	if err != nil {
+		return false, err
+	}
+
+	uiHook := &UIHook{
+		ui:      ui,
+		verbose: verbose,
+	}
+	stateHook := &StateHook{
+		OutputFilename: filename,
 	}
 
 	ctx := &padstone.Context{
 		Config:        config,
+		Targets:       padstone.StateTargetNames(state),
 		State:         state,
 		Providers:     sysConfig.ProviderFactories(),
 		Provisioners:  sysConfig.ProvisionerFactories(),
 		Variables:     variables,
 		Hooks:         []terraform.Hook{stateHook, uiHook},
-		UIInput:       c.ui,
+		UIInput:       ui,
 		ModuleStorage: storage,
 	}
 
-	warns, errs := ctx.Validate()
-	for _, warning := range warns {
-		c.ui.Warn(warning)
+	diags := ctx.Validate()
+	for _, diag := range diags.Warnings() {
+		ui.Warn(diag.Error())
 	}
-	if len(errs) > 0 {
-		for _, err := range errs {
-			c.ui.Error(err.Error())
+	if diags.HasErrors() {
+		for _, diag := range diags.Errors() {
+			ui.Error(diag.Error())
 		}
-		return fmt.Errorf("aborted due to configuration errors.")
+		return false, fmt.Errorf("aborted due to configuration errors.")
 	}
 
 	err = ctx.Destroy()
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	rootState := ctx.State.RootModule()
-	moduleCount := len(ctx.State.Modules)
-
-	if moduleCount == 1 && len(rootState.Resources) == 0 {
-		c.ui.Info("All resources destroyed")
-		err := os.Remove(c.Args.StateFile)
-		if err != nil {
-			return fmt.Errorf("Failed to remove state file %s: %s", c.Args.StateFile, err)
-		}
-	} else {
-		c.ui.Warn(fmt.Sprintf("Not all resources were destroyed. State file %s updated to reflect remaining resources.", c.Args.StateFile))
+	if padstone.StateHasResources(ctx.State) {
+		ui.Warn(fmt.Sprintf("Not all resources were destroyed. State file %s updated to reflect remaining resources.", filename))
 		_, err = stateHook.PostStateUpdate(ctx.State)
-		if err != nil {
-			return err
-		}
+		return false, err
 	}
 
-	return nil
+	ui.Info(fmt.Sprintf("All resources recorded in %s destroyed", filename))
+	err = os.Remove(filename)
+	if err != nil {
+		return false, fmt.Errorf("Failed to remove state file %s: %s", filename, err)
+	}
+	return true, nil
 }
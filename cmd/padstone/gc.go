@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+type GCCommand struct {
+	ui *UI
+
+	Verbose bool          `short:"v" long:"verbose" description:"show detailed information about resources"`
+	DryRun  bool          `long:"dry-run" description:"list the expired builds without destroying them"`
+	Args    GCCommandArgs `positional-args:"true" required:"true"`
+}
+
+type GCCommandArgs struct {
+	StateDir string `positional-arg-name:"state-dir" description:"path to a directory containing the state files of earlier builds"`
+}
+
+func (c *GCCommand) Execute(args []string) error {
+	sysConfig := BuiltinConfig
+	sysConfig.Discover()
+
+	expired, err := c.findExpired(time.Now())
+	if err != nil {
+		return err
+	}
+
+	if len(expired) == 0 {
+		c.ui.Info("No builds have expired.")
+		return nil
+	}
+
+	c.ui.Output("Expired builds:")
+	for _, build := range expired {
+		c.ui.Output(fmt.Sprintf("  %s (expired %s)", build.StateFile, build.Meta.ExpiresAt.Format(time.RFC3339)))
+	}
+
+	if c.DryRun {
+		return nil
+	}
+
+	var failed []string
+	for _, build := range expired {
+		c.ui.Info(fmt.Sprintf("--- Destroying %s... ---", build.StateFile))
+		err := c.destroy(&sysConfig, build)
+		if err != nil {
+			c.ui.Error(fmt.Sprintf("error destroying %s: %s", build.StateFile, err))
+			failed = append(failed, build.StateFile)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to destroy %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// findExpired returns the builds in the state directory that had expired
+// at the given time, other than those that are published or protected.
+func (c *GCCommand) findExpired(now time.Time) ([]*stateDirBuild, error) {
+	builds, err := readStateDir(c.ui, c.Args.StateDir, c.Verbose)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*stateDirBuild
+	for _, build := range builds {
+		if !build.Meta.Expired(now) {
+			continue
+		}
+		switch {
+		case build.Meta.Protected:
+			c.ui.Info(fmt.Sprintf("Skipping %s: it has expired, but is protected", build.StateFile))
+		case build.Meta.Published:
+			c.ui.Info(fmt.Sprintf("Skipping %s: it has expired, but has been published", build.StateFile))
+		default:
+			ret = append(ret, build)
+		}
+	}
+
+	return ret, nil
+}
+
+// destroy destroys the given build, along with any temporary resources it
+// left behind.
+func (c *GCCommand) destroy(sysConfig *Config, build *stateDirBuild) error {
+	stateFiles := []string{build.StateFile}
+	for _, filename := range []string{temporaryStateFilename(build.StateFile), leftoversStateFilename(build.StateFile)} {
+		if _, err := os.Lstat(filename); err == nil {
+			stateFiles = append(stateFiles, filename)
+		}
+	}
+
+	for _, filename := range stateFiles {
+		config, variables, err := destroyConfig(c.ui, filename, build.Meta.ConfigPath, nil)
+		if err != nil {
+			return err
+		}
+
+		destroyed, err := destroyStateFile(c.ui, sysConfig, config, filename, variables, c.Verbose)
+		if err != nil {
+			return err
+		}
+		if !destroyed {
+			return fmt.Errorf("not all resources were destroyed")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apparentlymart/padstone/padstone"
+)
+
+type InfoCommand struct {
+	ui *UI
+
+	Args InfoCommandArgs `positional-args:"true" required:"true"`
+}
+
+type InfoCommandArgs struct {
+	StateFile string `positional-arg-name:"state-file" description:"path to the state file of the build"`
+}
+
+func (c *InfoCommand) Execute(args []string) error {
+	state, err := ReadStateFile(c.Args.StateFile)
+	if err != nil {
+		return err
+	}
+
+	meta, err := padstone.StateMetadata(state)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range buildMetadataLines(meta) {
+		c.ui.Output(line)
+	}
+	return nil
+}
+
+// buildMetadataLines returns the given build metadata formatted for
+// display, one line per element.
+func buildMetadataLines(meta *padstone.BuildMetadata) []string {
+	if meta.BuildID == "" {
+		return []string{"Build (no metadata recorded)"}
+	}
+
+	lines := []string{
+		fmt.Sprintf("Build %s:", meta.BuildID),
+	}
+	add := func(label, value string) {
+		if value != "" {
+			lines = append(lines, fmt.Sprintf("  %-19s %s", label+":", value))
+		}
+	}
+
+	add("Padstone version", meta.PadstoneVersion)
+	add("Started", formatTime(meta.StartedAt))
+	if meta.FinishedAt.IsZero() && !meta.StartedAt.IsZero() {
+		add("Finished", "(not finished)")
+	} else {
+		add("Finished", formatTime(meta.FinishedAt))
+	}
+	if meta.User != "" && meta.Host != "" {
+		add("Built by", meta.User+"@"+meta.Host)
+	} else {
+		add("Built by", meta.User+meta.Host)
+	}
+	add("Configuration", meta.ConfigPath)
+	add("Configuration hash", meta.ConfigHash)
+	add("Targets", listOrNone(meta.Targets))
+	if len(meta.TemporaryTargets) > 0 {
+		add("Temporary targets", strings.Join(meta.TemporaryTargets, ", "))
+	}
+	add("Expires", formatTime(meta.ExpiresAt))
+
+	var flags []string
+	if meta.Protected {
+		flags = append(flags, "protected")
+	}
+	if meta.Published {
+		flags = append(flags, "published")
+	}
+	add("Status", strings.Join(flags, ", "))
+
+	if len(meta.Variables) > 0 {
+		lines = append(lines, "  Variables:")
+		for _, k := range sortedKeys(meta.Variables) {
+			lines = append(lines, fmt.Sprintf("    %s = %v", k, meta.Variables[k]))
+		}
+	}
+	if len(meta.Labels) > 0 {
+		lines = append(lines, "  Labels:")
+		keys := make([]string, 0, len(meta.Labels))
+		for k := range meta.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			lines = append(lines, fmt.Sprintf("    %s = %s", k, meta.Labels[k]))
+		}
+	}
+
+	return lines
+}
+
+// formatTime returns the given time formatted for display, or an empty
+// string for the zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// sortedKeys returns the keys of the given map in lexical order.
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apparentlymart/padstone/padstone"
+)
+
+type ListCommand struct {
+	ui *UI
+
+	Labels    []string        `short:"l" long:"label" value-name:"KEY=VALUE" description:"list only builds with the given label; may be repeated"`
+	OlderThan string          `long:"older-than" value-name:"AGE" description:"list only builds older than the given age, such as 7d or 12h"`
+	Targets   []string        `short:"t" long:"target" description:"list only builds that kept the given target; may be repeated"`
+	Sort      string          `long:"sort" choice:"age" choice:"name" choice:"id" choice:"resources" default:"age" description:"how to order the builds"`
+	Reverse   bool            `long:"reverse" description:"list the builds in the reverse order"`
+	JSON      bool            `long:"json" description:"write the list as JSON, for use by other programs"`
+	Verbose   bool            `short:"v" long:"verbose" description:"note any files that are skipped because they are not state files"`
+	Args      ListCommandArgs `positional-args:"true" required:"true"`
+}
+
+type ListCommandArgs struct {
+	StateDir string `positional-arg-name:"state-dir" description:"path to a directory containing the state files of earlier builds"`
+}
+
+// listedBuild is the summary of a build shown by the list command, which
+// is also its JSON representation.
+type listedBuild struct {
+	StateFile string                 `json:"state_file"`
+	BuildID   string                 `json:"build_id,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+	Age       time.Duration          `json:"-"`
+	Targets   []string               `json:"targets"`
+	Resources map[string]int         `json:"resources"`
+	Outputs   map[string]interface{} `json:"outputs"`
+	Labels    map[string]string      `json:"labels"`
+}
+
+// ResourceCount returns the total number of resources in the build.
+func (b *listedBuild) ResourceCount() int {
+	count := 0
+	for _, n := range b.Resources {
+		count += n
+	}
+	return count
+}
+
+func (c *ListCommand) Execute(args []string) error {
+	now := time.Now()
+
+	labels, err := decodeKVSpecs(c.Labels)
+	if err != nil {
+		return err
+	}
+
+	var olderThan time.Duration
+	if c.OlderThan != "" {
+		olderThan, err = parseAge(c.OlderThan)
+		if err != nil {
+			return fmt.Errorf("invalid --older-than: %s", err)
+		}
+	}
+
+	builds, err := readStateDir(c.ui, c.Args.StateDir, c.Verbose)
+	if err != nil {
+		return err
+	}
+
+	listed := []*listedBuild{}
+	for _, build := range builds {
+		summary := summarizeBuild(build, now)
+
+		if summary.Age < olderThan {
+			continue
+		}
+		if !hasLabels(summary.Labels, labels) {
+			continue
+		}
+		keep := true
+		for _, target := range c.Targets {
+			keep = keep && containsString(summary.Targets, target)
+		}
+		if !keep {
+			continue
+		}
+
+		listed = append(listed, summary)
+	}
+
+	sort.Stable(listedBuildSort{listed, c.Sort})
+	if c.Reverse {
+		for i, j := 0, len(listed)-1; i < j; i, j = i+1, j-1 {
+			listed[i], listed[j] = listed[j], listed[i]
+		}
+	}
+
+	if c.JSON {
+		buf, err := json.MarshalIndent(listed, "", "  ")
+		if err != nil {
+			return err
+		}
+		c.ui.Output(string(buf))
+		return nil
+	}
+
+	if len(listed) == 0 {
+		c.ui.Info("No builds found.")
+		return nil
+	}
+
+	for _, build := range listed {
+		c.ui.Output(fmt.Sprintf("\n%s:", build.StateFile))
+		if build.BuildID != "" {
+			c.ui.Output(fmt.Sprintf("  Build ID:  %s", build.BuildID))
+		}
+		c.ui.Output(fmt.Sprintf("  Age:       %s", formatAge(build.Age)))
+		c.ui.Output(fmt.Sprintf("  Targets:   %s", listOrNone(build.Targets)))
+
+		counts := make([]string, len(build.Targets))
+		for i, target := range build.Targets {
+			counts[i] = fmt.Sprintf("%s %d", target, build.Resources[target])
+		}
+		if len(counts) > 1 {
+			c.ui.Output(fmt.Sprintf("  Resources: %d (%s)", build.ResourceCount(), strings.Join(counts, ", ")))
+		} else {
+			c.ui.Output(fmt.Sprintf("  Resources: %d", build.ResourceCount()))
+		}
+
+		if len(build.Labels) > 0 {
+			var pairs []string
+			for k, v := range build.Labels {
+				pairs = append(pairs, k+"="+v)
+			}
+			sort.Strings(pairs)
+			c.ui.Output(fmt.Sprintf("  Labels:    %s", strings.Join(pairs, ", ")))
+		}
+
+		if len(build.Outputs) > 0 {
+			c.ui.Output("  Outputs:")
+			for _, k := range sortedKeys(build.Outputs) {
+				c.ui.Output(fmt.Sprintf("    %s = %v", k, build.Outputs[k]))
+			}
+		}
+	}
+	c.ui.Output("")
+
+	return nil
+}
+
+// summarizeBuild returns the summary of the given build that is shown by
+// the list command.
+func summarizeBuild(build *stateDirBuild, now time.Time) *listedBuild {
+	ret := &listedBuild{
+		StateFile: build.StateFile,
+		BuildID:   build.Meta.BuildID,
+		CreatedAt: build.Meta.StartedAt,
+		Targets:   padstone.StateTargetNames(build.State),
+		Resources: make(map[string]int),
+		Outputs:   make(map[string]interface{}),
+		Labels:    build.Meta.Labels,
+	}
+
+	// Builds made before metadata was recorded are dated by their state
+	// file instead.
+	if ret.CreatedAt.IsZero() {
+		ret.CreatedAt = build.ModTime.UTC()
+	}
+	ret.Age = now.Sub(ret.CreatedAt)
+
+	if ret.Labels == nil {
+		ret.Labels = make(map[string]string)
+	}
+
+	for _, target := range ret.Targets {
+		ret.Resources[target] = 0
+	}
+	for _, res := range padstone.StateResources(build.State) {
+		ret.Resources[res.Target]++
+	}
+
+	for k, output := range build.State.RootModule().Outputs {
+		if output.Sensitive {
+			ret.Outputs[k] = "<sensitive>"
+		} else {
+			ret.Outputs[k] = output.Value
+		}
+	}
+
+	return ret
+}
+
+// hasLabels returns true if the given labels include all of the wanted
+// labels, with the same values.
+func hasLabels(labels, want map[string]string) bool {
+	for k, v := range want {
+		if got, ok := labels[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// listedBuildSort sorts builds by one of the keys offered by the list
+// command's --sort option.
+type listedBuildSort struct {
+	builds []*listedBuild
+	key    string
+}
+
+func (s listedBuildSort) Len() int {
+	return len(s.builds)
+}
+
+func (s listedBuildSort) Swap(i, j int) {
+	s.builds[i], s.builds[j] = s.builds[j], s.builds[i]
+}
+
+func (s listedBuildSort) Less(i, j int) bool {
+	a, b := s.builds[i], s.builds[j]
+	switch s.key {
+	case "name":
+		return a.StateFile < b.StateFile
+	case "id":
+		return a.BuildID < b.BuildID
+	case "resources":
+		return a.ResourceCount() < b.ResourceCount()
+	default:
+		return a.Age < b.Age
+	}
+}
@@ -47,14 +47,94 @@ func main() {
 			ui: ui,
 		},
 	)
+	clParser.AddCommand(
+		"plan",
+		"Show what a build would do",
+		"The 'plan' command shows the resources a build would create, without creating them",
+		&PlanCommand{
+			ui: ui,
+		},
+	)
 	clParser.AddCommand(
 		"destroy",
 		"Destroy the results of a build",
-		"The 'destroy' command destroys the resources from an earlier build",
+		"The 'destroy' command destroys the resources from an earlier build, using the provider configuration recorded in its state, or the configuration given with --config if the state does not record enough",
 		&DestroyCommand{
 			ui: ui,
 		},
 	)
+	clParser.AddCommand(
+		"cleanup",
+		"Destroy temporary resources kept by a build",
+		"The 'cleanup' command destroys the temporary resources of an earlier build that were kept with --keep-temporary or that it failed to destroy",
+		&CleanupCommand{
+			ui: ui,
+		},
+	)
+	clParser.AddCommand(
+		"recover",
+		"Recover the state of a build that was killed",
+		"The 'recover' command reconciles the journal of a build that was killed into a state file that can be used with 'padstone destroy'",
+		&RecoverCommand{
+			ui: ui,
+		},
+	)
+	clParser.AddCommand(
+		"validate",
+		"Check a configuration for errors",
+		"The 'validate' command checks a configuration for errors without creating any resources",
+		&ValidateCommand{
+			ui: ui,
+		},
+	)
+	clParser.AddCommand(
+		"targets",
+		"List the targets in a configuration",
+		"The 'targets' command lists each target in a configuration along with its dependencies, resources and outputs",
+		&TargetsCommand{
+			ui: ui,
+		},
+	)
+	clParser.AddCommand(
+		"output",
+		"Show the outputs of a build",
+		"The 'output' command shows the outputs of a build, or of one of its targets, either for display, as JSON, or as an environment file",
+		&OutputCommand{
+			ui: ui,
+		},
+	)
+	clParser.AddCommand(
+		"show",
+		"Show a report of a build",
+		"The 'show' command describes the resources and outputs of each target of a build, along with its metadata; it also accepts the partial state of a failed build and the .temporary and .leftovers files",
+		&ShowCommand{
+			ui: ui,
+		},
+	)
+	clParser.AddCommand(
+		"info",
+		"Show the metadata of a build",
+		"The 'info' command shows the metadata recorded in the state file of a build, such as its ID, when and by whom it was made, its targets, variables and labels",
+		&InfoCommand{
+			ui: ui,
+		},
+	)
+	clParser.AddCommand(
+		"list",
+		"List the builds in a directory",
+		"The 'list' command summarizes each build in a directory of state files, with its ID, age, targets, resource counts, outputs and labels",
+		&ListCommand{
+			ui: ui,
+		},
+	)
+	clParser.AddCommand(
+		"gc",
+		"Destroy expired builds",
+		"The 'gc' command destroys the builds in a directory of state files whose TTL has passed, other than those that are published or protected",
+		&GCCommand{
+			ui: ui,
+		},
+	)
 	clParser.AddCommand(
 		"publish",
 		"Publish a state file to remote storage",
@@ -65,6 +145,25 @@ func main() {
 	)
 
 	if _, err := clParser.Parse(); err != nil {
+		if exitErr, ok := err.(*exitError); ok {
+			os.Exit(exitErr.Code)
+		}
 		os.Exit(1)
 	}
 }
+
+// exitLeakedResources is the exit status when a command fails to destroy
+// temporary or partially-built resources, so that automation can
+// distinguish orphaned infrastructure from other failures.
+const exitLeakedResources = 3
+
+// exitError is an error that causes the program to exit with a particular
+// status, rather than the usual status of 1.
+type exitError struct {
+	Err  error
+	Code int
+}
+
+func (e *exitError) Error() string {
+	return e.Err.Error()
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/apparentlymart/padstone/padstone"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+type OutputCommand struct {
+	ui *UI
+
+	Target string            `short:"t" long:"target" description:"show the outputs of the given target, rather than those of the build's kept targets"`
+	JSON   bool              `long:"json" description:"write the outputs as JSON"`
+	Env    bool              `long:"env" description:"write the outputs as KEY=value lines, suitable for an environment file"`
+	Args   OutputCommandArgs `positional-args:"true"`
+}
+
+type OutputCommandArgs struct {
+	StateFile string `positional-arg-name:"state-file" required:"true" description:"path to the state file of the build"`
+	Name      string `positional-arg-name:"name" description:"name of a single output to show; its value is written alone, for use in shell scripts"`
+}
+
+func (c *OutputCommand) Execute(args []string) error {
+	if c.JSON && c.Env {
+		return fmt.Errorf("--json and --env cannot be used together")
+	}
+
+	state, err := ReadStateFile(c.Args.StateFile)
+	if err != nil {
+		return err
+	}
+
+	outputs, err := stateOutputs(state, c.Target)
+	if err != nil {
+		return err
+	}
+
+	if c.Args.Name != "" {
+		output, exists := outputs[c.Args.Name]
+		if !exists {
+			if c.Target != "" {
+				return fmt.Errorf("target %s has no output %q", c.Target, c.Args.Name)
+			}
+			return fmt.Errorf("build has no output %q; use --target to see the outputs of a temporary target", c.Args.Name)
+		}
+		outputs = map[string]*terraform.OutputState{
+			c.Args.Name: output,
+		}
+	}
+
+	names := make([]string, 0, len(outputs))
+	for k := range outputs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	switch {
+	case c.JSON:
+		var v interface{}
+		if c.Args.Name != "" {
+			v = outputs[c.Args.Name].Value
+		} else {
+			values := make(map[string]interface{}, len(outputs))
+			for k, output := range outputs {
+				values[k] = output.Value
+			}
+			v = values
+		}
+		buf, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		c.ui.Output(string(buf))
+	case c.Env:
+		for _, k := range names {
+			value, err := rawOutputValue(outputs[k].Value)
+			if err != nil {
+				return err
+			}
+			c.ui.Output(fmt.Sprintf("%s=%s", envKey(k), shellQuote(value)))
+		}
+	case c.Args.Name != "":
+		value, err := rawOutputValue(outputs[c.Args.Name].Value)
+		if err != nil {
+			return err
+		}
+		c.ui.Output(value)
+	default:
+		if len(outputs) == 0 {
+			c.ui.Info("There are no outputs.")
+		}
+		for _, line := range outputLines(outputs) {
+			c.ui.Output(line)
+		}
+	}
+
+	return nil
+}
+
+// stateOutputs returns the outputs of the target with the given name in the
+// given result state, or the outputs of the build's kept targets if the
+// name is empty.
+func stateOutputs(state *terraform.State, targetName string) (map[string]*terraform.OutputState, error) {
+	path := []string{"root"}
+	if targetName != "" {
+		path = append(path, targetName)
+	}
+
+	mod := state.ModuleByPath(path)
+	if mod == nil {
+		if targetName != "" {
+			return nil, fmt.Errorf("state has no target %s; it has %s", targetName, listOrNone(padstone.StateTargetNames(state)))
+		}
+		return map[string]*terraform.OutputState{}, nil
+	}
+	return mod.Outputs, nil
+}
+
+// outputLines returns the given outputs formatted for display, one line
+// per output in lexical order. Sensitive values are not shown.
+func outputLines(outputs map[string]*terraform.OutputState) []string {
+	names := make([]string, 0, len(outputs))
+	for k := range outputs {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, len(names))
+	for i, k := range names {
+		output := outputs[k]
+		if output.Sensitive {
+			lines[i] = fmt.Sprintf("- %s = <sensitive>", k)
+		} else {
+			lines[i] = fmt.Sprintf("- %s = %v", k, output.Value)
+		}
+	}
+	return lines
+}
+
+// rawOutputValue returns the given output value as it is written alone: a
+// string as-is, and a list or map as JSON.
+func rawOutputValue(v interface{}) (string, error) {
+	if s, ok := v.(string); ok {
+		return s, nil
+	}
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// envKey returns the environment variable name for the output with the
+// given name.
+func envKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
+
+// shellQuote returns the given string quoted, if necessary, so that it is
+// read back unchanged by a POSIX shell.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./:,@%+") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/apparentlymart/padstone/padstone"
+
+	getter "github.com/hashicorp/go-getter"
+	tfcmd "github.com/hashicorp/terraform/command"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+type PlanCommand struct {
+	ui    *UI
+	input *tfcmd.UIInput
+
+	Dev     bool            `long:"dev" description:"keep the configuration's default development targets rather than its default build targets"`
+	Targets []string        `short:"t" long:"target" description:"name of a target to keep, building any targets it depends on as temporary targets; may be repeated"`
+	OutFile string          `short:"o" long:"out" description:"path where the plan will be saved, for later use with 'padstone build --plan'"`
+	Args    PlanCommandArgs `positional-args:"true" required:"true"`
+}
+
+type PlanCommandArgs struct {
+	ConfigDir string   `positional-arg-name:"config-dir" description:"path to the directory containing the build configuration"`
+	VarSpecs  []string `positional-args:"true" positional-arg-name:"varname=value" description:"zero or more explicit variable value specifications"`
+}
+
+func (c *PlanCommand) Execute(args []string) error {
+	sysConfig := BuiltinConfig
+	sysConfig.Discover()
+
+	config, err := padstone.LoadConfig(c.Args.ConfigDir)
+	if err != nil {
+		return err
+	}
+
+	if err := checkConfig(c.ui, config); err != nil {
+		return err
+	}
+
+	targets, err := selectedTargets(config, c.Targets, c.Dev)
+	if err != nil {
+		return err
+	}
+
+	graph, err := config.TargetGraph()
+	if err != nil {
+		return err
+	}
+
+	selection, err := graph.Select(targets)
+	if err != nil {
+		return err
+	}
+
+	variables, err := decodeKVSpecs(c.Args.VarSpecs)
+	if err != nil {
+		return err
+	}
+
+	ctx := &padstone.Context{
+		Config:       config,
+		Targets:      targets,
+		State:        terraform.NewState(),
+		Providers:    sysConfig.ProviderFactories(),
+		Provisioners: sysConfig.ProvisionerFactories(),
+		Variables:    variables,
+		UIInput:      c.ui,
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: ".padstone",
+		},
+	}
+
+	diags := ctx.Validate()
+	for _, diag := range diags.Warnings() {
+		c.ui.Warn(diag.Error())
+	}
+	if diags.HasErrors() {
+		for _, diag := range diags.Errors() {
+			c.ui.Error(diag.Error())
+		}
+		return fmt.Errorf("aborted due to configuration errors.")
+	}
+
+	plan, err := ctx.Plan()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range selection.Order {
+		if selection.IsTemporary(name) {
+			c.ui.Output(fmt.Sprintf("\nTarget %s (temporary; destroyed after the build):", name))
+		} else {
+			c.ui.Output(fmt.Sprintf("\nTarget %s:", name))
+		}
+
+		changes := plan.ResourceChanges(name)
+		if len(changes) == 0 {
+			c.ui.Output("  (no changes)")
+		}
+		for _, change := range changes {
+			c.ui.Output(fmt.Sprintf("  %s", change))
+		}
+
+		if !selection.IsTemporary(name) {
+			target := config.Target(name)
+			if len(target.Outputs) > 0 {
+				names := make([]string, len(target.Outputs))
+				for i, output := range target.Outputs {
+					names[i] = output.Name
+				}
+				c.ui.Output(fmt.Sprintf("  Outputs to keep: %s", strings.Join(names, ", ")))
+			}
+		}
+	}
+
+	c.ui.Output("")
+	c.ui.Info(fmt.Sprintf("Targets to keep: %s", strings.Join(selection.Kept, ", ")))
+	if len(selection.Temporary) > 0 {
+		c.ui.Info(fmt.Sprintf("Temporary targets: %s", strings.Join(selection.Temporary, ", ")))
+	}
+
+	if c.OutFile != "" {
+		f, err := os.Create(c.OutFile)
+		if err != nil {
+			return fmt.Errorf("error creating plan file %s: %s", c.OutFile, err)
+		}
+		defer f.Close()
+
+		err = padstone.WritePlan(plan, f)
+		if err != nil {
+			return fmt.Errorf("error writing plan file %s: %s", c.OutFile, err)
+		}
+
+		c.ui.Info(fmt.Sprintf("Plan saved to %s; run 'padstone build --plan=%s' to execute it.", c.OutFile, c.OutFile))
+	}
+
+	return nil
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
+
+	"github.com/apparentlymart/padstone/padstone"
 
 	tfcmd "github.com/hashicorp/terraform/command"
 	tfremote "github.com/hashicorp/terraform/state/remote"
+	"github.com/hashicorp/terraform/terraform"
 )
 
 type PublishCommand struct {
@@ -33,15 +36,33 @@ func (c *PublishCommand) Execute(args []string) error {
 		return err
 	}
 
-	stateBytes, err := ioutil.ReadFile(c.Args.StateFile)
+	state, err := ReadStateFile(c.Args.StateFile)
+	if err != nil {
+		return err
+	}
+
+	// The build is marked as published both in what is published and in
+	// the local state file, so that 'padstone gc' will leave it alone.
+	meta, err := padstone.StateMetadata(state)
 	if err != nil {
 		return fmt.Errorf("error reading state file %s: %s", c.Args.StateFile, err)
 	}
+	meta.Published = true
+	err = padstone.SetStateMetadata(state, meta)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = terraform.WriteState(state, &buf)
+	if err != nil {
+		return fmt.Errorf("error encoding state: %s", err)
+	}
 
-	err = client.Put(stateBytes)
+	err = client.Put(buf.Bytes())
 	if err != nil {
 		return fmt.Errorf("error publishing state to %s: %s", c.Args.StorageBackend, err)
 	}
 
-	return nil
+	return WriteState(state, c.Args.StateFile)
 }
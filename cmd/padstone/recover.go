@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/apparentlymart/padstone/padstone"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+type RecoverCommand struct {
+	ui *UI
+
+	OutFile string             `short:"o" long:"out" description:"path of the state file to write, which is updated if it already exists (default: the journal's path without its .journal suffix)"`
+	Args    RecoverCommandArgs `positional-args:"true" required:"true"`
+}
+
+type RecoverCommandArgs struct {
+	JournalFile string `positional-arg-name:"journal" description:"path to the journal of a build that was killed"`
+}
+
+func (c *RecoverCommand) Execute(args []string) error {
+	outFile := c.OutFile
+	if outFile == "" {
+		if !strings.HasSuffix(c.Args.JournalFile, ".journal") {
+			return fmt.Errorf("journal %s does not have a .journal suffix, so the state file must be given with --out", c.Args.JournalFile)
+		}
+		outFile = strings.TrimSuffix(c.Args.JournalFile, ".journal")
+	}
+
+	f, err := os.Open(c.Args.JournalFile)
+	if err != nil {
+		return fmt.Errorf("error opening journal: %s", err)
+	}
+	defer f.Close()
+
+	entries, err := padstone.ReadJournal(f)
+	if err != nil {
+		return err
+	}
+
+	// The state file records everything up to the last update that was
+	// written, and the journal fills in anything that happened after it.
+	state := terraform.NewState()
+	if _, err := os.Lstat(outFile); err == nil {
+		state, err = ReadStateFile(outFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	unfinished := padstone.RecoverState(state, entries)
+
+	err = WriteState(state, outFile)
+	if err != nil {
+		return err
+	}
+
+	for _, res := range padstone.StateResources(state) {
+		c.ui.Output(fmt.Sprintf("  %s: %s %s", res.Target, res.Address, res.ID))
+	}
+	c.ui.Info(fmt.Sprintf("Recovered state written to %s; run 'padstone destroy' with it to destroy these resources.", outFile))
+
+	if len(unfinished) > 0 {
+		c.ui.Warn("The following changes were started but never finished, so their resources may exist without being recorded:")
+		for _, entry := range unfinished {
+			c.ui.Warn(fmt.Sprintf("  %s", entry))
+		}
+		c.ui.Warn(fmt.Sprintf("Check for these by hand, then remove %s.", c.Args.JournalFile))
+		return nil
+	}
+
+	// Everything in the journal is now recorded in the state file.
+	f.Close()
+	err = os.Remove(c.Args.JournalFile)
+	if err != nil {
+		return fmt.Errorf("error removing journal: %s", err)
+	}
+
+	return nil
+}
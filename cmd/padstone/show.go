@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/apparentlymart/padstone/padstone"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+type ShowCommand struct {
+	ui *UI
+
+	Verbose bool            `short:"v" long:"verbose" description:"show all of the attributes of each resource"`
+	JSON    bool            `long:"json" description:"write the report as JSON, for use by other programs"`
+	Args    ShowCommandArgs `positional-args:"true" required:"true"`
+}
+
+type ShowCommandArgs struct {
+	StateFile string `positional-arg-name:"state-file" description:"path to the state file of the build, or to its .temporary or .leftovers file"`
+}
+
+// buildReport is the description of a build shown by the show command,
+// which is also its JSON representation.
+type buildReport struct {
+	StateFile string                  `json:"state_file"`
+	Metadata  *padstone.BuildMetadata `json:"metadata"`
+	Targets   []*targetReport         `json:"targets"`
+
+	// CleanedUp is the names of the build's temporary targets that have
+	// already been destroyed.
+	CleanedUp []string `json:"cleaned_up_targets"`
+
+	// Notes describe anything unusual about the state, such as a build
+	// that did not finish.
+	Notes []string `json:"notes"`
+}
+
+type targetReport struct {
+	Name      string                 `json:"name"`
+	Temporary bool                   `json:"temporary"`
+	Resources []*resourceReport      `json:"resources"`
+	Outputs   map[string]interface{} `json:"outputs"`
+
+	outputs map[string]*terraform.OutputState
+}
+
+type resourceReport struct {
+	Address    string            `json:"address"`
+	Type       string            `json:"type"`
+	ID         string            `json:"id"`
+	Tainted    bool              `json:"tainted"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+func (c *ShowCommand) Execute(args []string) error {
+	state, err := ReadStateFile(c.Args.StateFile)
+	if err != nil {
+		return err
+	}
+
+	report, err := newBuildReport(c.Args.StateFile, state)
+	if err != nil {
+		return err
+	}
+
+	if c.JSON {
+		buf, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		c.ui.Output(string(buf))
+		return nil
+	}
+
+	for _, line := range buildMetadataLines(report.Metadata) {
+		c.ui.Output(line)
+	}
+
+	for _, target := range report.Targets {
+		if target.Temporary {
+			c.ui.Output(fmt.Sprintf("\nTarget %s (temporary, not cleaned up):", target.Name))
+		} else {
+			c.ui.Output(fmt.Sprintf("\nTarget %s:", target.Name))
+		}
+
+		if len(target.Resources) == 0 {
+			c.ui.Output("  (no resources)")
+		}
+		for _, res := range target.Resources {
+			switch {
+			case res.ID == "":
+				c.ui.Output(fmt.Sprintf("  %s (not created)", res.Address))
+			case res.Tainted:
+				c.ui.Output(fmt.Sprintf("  %s: %s (tainted)", res.Address, res.ID))
+			default:
+				c.ui.Output(fmt.Sprintf("  %s: %s", res.Address, res.ID))
+			}
+
+			keys := make([]string, 0, len(res.Attributes))
+			for k := range res.Attributes {
+				// Unless verbose, only the simple attributes are shown,
+				// since the elements of lists and maps are numerous.
+				if k == "id" || (!c.Verbose && strings.Contains(k, ".")) {
+					continue
+				}
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				c.ui.Output(fmt.Sprintf("    %s = %s", k, res.Attributes[k]))
+			}
+		}
+
+		if len(target.outputs) > 0 {
+			c.ui.Output("  Outputs:")
+			for _, line := range outputLines(target.outputs) {
+				c.ui.Output("  " + line)
+			}
+		}
+	}
+
+	if len(report.CleanedUp) > 0 {
+		c.ui.Output(fmt.Sprintf("\nTemporary targets already cleaned up: %s", strings.Join(report.CleanedUp, ", ")))
+	}
+
+	for _, note := range report.Notes {
+		c.ui.Output("")
+		c.ui.Warn(note)
+	}
+	c.ui.Output("")
+
+	return nil
+}
+
+// newBuildReport describes the build recorded in the given state, which
+// was read from the given file.
+func newBuildReport(filename string, state *terraform.State) (*buildReport, error) {
+	meta, err := padstone.StateMetadata(state)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &buildReport{
+		StateFile: filename,
+		Metadata:  meta,
+		Targets:   []*targetReport{},
+		CleanedUp: []string{},
+		Notes:     []string{},
+	}
+
+	targets := make(map[string]*targetReport)
+	addTarget := func(name string) *targetReport {
+		if target := targets[name]; target != nil {
+			return target
+		}
+		target := &targetReport{
+			Name:      name,
+			Temporary: containsString(meta.TemporaryTargets, name),
+			Resources: []*resourceReport{},
+			Outputs:   make(map[string]interface{}),
+		}
+		targets[name] = target
+		report.Targets = append(report.Targets, target)
+		return target
+	}
+	for _, name := range padstone.StateTargetNames(state) {
+		addTarget(name)
+	}
+
+	for _, mod := range state.Modules {
+		if len(mod.Path) < 2 || mod.Path[0] != "root" {
+			continue
+		}
+		target := addTarget(mod.Path[1])
+
+		if len(mod.Path) == 2 {
+			target.outputs = mod.Outputs
+			for k, output := range mod.Outputs {
+				// Sensitive values are masked as they are in the
+				// human-readable report; 'padstone output' shows them.
+				if output.Sensitive {
+					target.Outputs[k] = "<sensitive>"
+				} else {
+					target.Outputs[k] = output.Value
+				}
+			}
+		}
+
+		var prefix string
+		for _, name := range mod.Path[2:] {
+			prefix += "module." + name + "."
+		}
+		for key, rs := range mod.Resources {
+			res := &resourceReport{
+				Address:    prefix + key,
+				Type:       rs.Type,
+				Attributes: map[string]string{},
+			}
+			if rs.Primary != nil {
+				res.ID = rs.Primary.ID
+				res.Tainted = rs.Primary.Tainted
+				res.Attributes = rs.Primary.Attributes
+			}
+			target.Resources = append(target.Resources, res)
+		}
+	}
+	for _, target := range report.Targets {
+		sort.Sort(resourceReports(target.Resources))
+	}
+
+	var mainFile string
+	switch {
+	case strings.HasSuffix(filename, ".temporary"):
+		mainFile = strings.TrimSuffix(filename, ".temporary")
+		report.Notes = append(report.Notes, fmt.Sprintf(
+			"These are temporary targets that were kept rather than destroyed. Run 'padstone cleanup %s' to destroy them.", mainFile,
+		))
+	case strings.HasSuffix(filename, ".leftovers"):
+		mainFile = strings.TrimSuffix(filename, ".leftovers")
+		report.Notes = append(report.Notes, fmt.Sprintf(
+			"These are temporary targets that the build failed to destroy. Run 'padstone cleanup %s' to try again to destroy them.", mainFile,
+		))
+	default:
+		mainFile = filename
+
+		// Temporary targets that were moved into one of the other state
+		// files are not cleaned up, even though they are not here.
+		elsewhere := make(map[string]bool)
+		for _, sidecar := range []string{temporaryStateFilename(filename), leftoversStateFilename(filename)} {
+			if _, err := os.Lstat(sidecar); err != nil {
+				continue
+			}
+			report.Notes = append(report.Notes, fmt.Sprintf("Some temporary resources of this build are recorded in %s.", sidecar))
+
+			sidecarState, err := ReadStateFile(sidecar)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range padstone.StateTargetNames(sidecarState) {
+				elsewhere[name] = true
+			}
+		}
+
+		for _, name := range meta.TemporaryTargets {
+			if targets[name] == nil && !elsewhere[name] {
+				report.CleanedUp = append(report.CleanedUp, name)
+			}
+		}
+
+		if meta.BuildID != "" && meta.FinishedAt.IsZero() {
+			report.Notes = append(report.Notes, "This build did not finish, so this state may record only some of its resources.")
+		}
+	}
+
+	journal := journalFilename(mainFile)
+	if _, err := os.Lstat(journal); err == nil {
+		report.Notes = append(report.Notes, fmt.Sprintf(
+			"The journal %s still exists, so the build may have been killed and this state may be missing resources. Run 'padstone recover %s' to recover them.",
+			journal, journal,
+		))
+	}
+
+	return report, nil
+}
+
+type resourceReports []*resourceReport
+
+func (s resourceReports) Len() int {
+	return len(s)
+}
+
+func (s resourceReports) Less(i, j int) bool {
+	return s[i].Address < s[j].Address
+}
+
+func (s resourceReports) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
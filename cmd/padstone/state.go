@@ -2,7 +2,13 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apparentlymart/padstone/padstone"
 
 	"github.com/hashicorp/terraform/terraform"
 )
@@ -14,9 +20,106 @@ func WriteState(state *terraform.State, outFile string) error {
 	if err != nil {
 		return fmt.Errorf("error opening state file: %s\n", err)
 	}
+	defer f.Close()
 	err = terraform.WriteState(state, f)
 	if err != nil {
 		return fmt.Errorf("error writing state: %s\n", err)
 	}
 	return nil
 }
+
+func ReadStateFile(filename string) (*terraform.State, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening state file %s: %s", filename, err)
+	}
+	defer f.Close()
+
+	state, err := terraform.ReadState(f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading state file %s: %s", filename, err)
+	}
+	return state, nil
+}
+
+// temporaryStateFilename returns the name of the file where the temporary
+// targets of the build whose state is in the given file are recorded, if
+// the build kept them.
+func temporaryStateFilename(stateFile string) string {
+	return stateFile + ".temporary"
+}
+
+// leftoversStateFilename returns the name of the file where the temporary
+// targets of the build whose state is in the given file are recorded, if
+// the build failed to destroy them.
+func leftoversStateFilename(stateFile string) string {
+	return stateFile + ".leftovers"
+}
+
+// journalFilename returns the name of the file where the journal of the
+// build whose state is in the given file is written.
+func journalFilename(stateFile string) string {
+	return stateFile + ".journal"
+}
+
+// isBuildSidecarFile returns true if the given filename is one of the
+// files that a build writes alongside its main state file.
+func isBuildSidecarFile(name string) bool {
+	for _, suffix := range []string{".journal", ".temporary", ".leftovers"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// stateDirBuild is a build whose state file was found by readStateDir.
+type stateDirBuild struct {
+	StateFile string
+	State     *terraform.State
+	Meta      *padstone.BuildMetadata
+	ModTime   time.Time
+}
+
+// readStateDir reads the state file of each build in the given directory.
+// Files that are not state files are skipped, with a note if verbose is
+// set, and so are the files a build writes alongside its state file.
+func readStateDir(ui *UI, dir string, verbose bool) ([]*stateDirBuild, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*stateDirBuild
+	for _, info := range infos {
+		if !info.Mode().IsRegular() || isBuildSidecarFile(info.Name()) {
+			continue
+		}
+
+		filename := filepath.Join(dir, info.Name())
+		state, err := ReadStateFile(filename)
+		if err != nil {
+			// Not every file in the directory is necessarily a state
+			// file.
+			if verbose {
+				ui.Info(fmt.Sprintf("Skipping %s: %s", filename, err))
+			}
+			continue
+		}
+
+		meta, err := padstone.StateMetadata(state)
+		if err != nil {
+			ui.Warn(fmt.Sprintf("Skipping %s: %s", filename, err))
+			continue
+		}
+
+		ret = append(ret, &stateDirBuild{
+			StateFile: filename,
+			State:     state,
+			Meta:      meta,
+			ModTime:   info.ModTime(),
+		})
+	}
+
+	return ret, nil
+}
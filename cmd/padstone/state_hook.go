@@ -1,6 +1,8 @@
 package main
 
 import (
+	"sync"
+
 	"github.com/hashicorp/terraform/terraform"
 )
 
@@ -8,9 +10,14 @@ type StateHook struct {
 	terraform.NilHook
 
 	OutputFilename string
+
+	lock sync.Mutex
 }
 
 func (h *StateHook) PostStateUpdate(state *terraform.State) (terraform.HookAction, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
 	err := WriteState(state, h.OutputFilename)
 	if err != nil {
 		return terraform.HookActionHalt, err
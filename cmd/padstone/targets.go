@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apparentlymart/padstone/padstone"
+)
+
+type TargetsCommand struct {
+	ui *UI
+
+	Args TargetsCommandArgs `positional-args:"true" required:"true"`
+}
+
+type TargetsCommandArgs struct {
+	ConfigDir string `positional-arg-name:"config-dir" description:"path to the directory containing the build configuration"`
+}
+
+func (c *TargetsCommand) Execute(args []string) error {
+	config, err := padstone.LoadConfig(c.Args.ConfigDir)
+	if err != nil {
+		return err
+	}
+
+	if err := checkConfig(c.ui, config); err != nil {
+		return err
+	}
+
+	graph, err := config.TargetGraph()
+	if err != nil {
+		return err
+	}
+
+	order, err := graph.Order()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range order {
+		target := config.Target(name)
+
+		var notes []string
+		if containsString(config.DefaultBuildTargets, name) {
+			notes = append(notes, "default build target")
+		}
+		if containsString(config.DefaultDevTargets, name) {
+			notes = append(notes, "default dev target")
+		}
+		if len(notes) > 0 {
+			c.ui.Output(fmt.Sprintf("\nTarget %s (%s):", name, strings.Join(notes, ", ")))
+		} else {
+			c.ui.Output(fmt.Sprintf("\nTarget %s:", name))
+		}
+
+		c.ui.Output(fmt.Sprintf("  Depends on: %s", listOrNone(graph.Dependencies(name))))
+
+		modules := make([]string, len(target.Modules))
+		for i, module := range target.Modules {
+			modules[i] = module.Name
+		}
+		if len(modules) > 0 {
+			c.ui.Output(fmt.Sprintf("  Modules:    %s", strings.Join(modules, ", ")))
+		}
+
+		resources := make([]string, len(target.Resources))
+		for i, resource := range target.Resources {
+			resources[i] = resource.Id()
+		}
+		c.ui.Output(fmt.Sprintf("  Resources:  %s", listOrNone(resources)))
+
+		outputs := make([]string, len(target.Outputs))
+		for i, output := range target.Outputs {
+			outputs[i] = output.Name
+		}
+		c.ui.Output(fmt.Sprintf("  Outputs:    %s", listOrNone(outputs)))
+	}
+	c.ui.Output("")
+
+	return nil
+}
+
+// selectedTargets returns the names of the targets to keep: those given
+// with --target if there are any, or otherwise the configuration's default
+// targets.
+func selectedTargets(config *padstone.Config, names []string, dev bool) ([]string, error) {
+	if len(names) == 0 {
+		return config.DefaultTargets(dev)
+	}
+	if dev {
+		return nil, fmt.Errorf("--dev cannot be used with --target, since --target already selects the targets")
+	}
+	return names, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func listOrNone(list []string) string {
+	if len(list) == 0 {
+		return "(none)"
+	}
+	return strings.Join(list, ", ")
+}
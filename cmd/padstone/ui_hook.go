@@ -9,28 +9,45 @@ import (
 type UIHook struct {
 	terraform.NilHook
 
-	ui *UI
+	ui      *UI
 	verbose bool
+	target  string
+}
+
+// ForTarget returns a copy of the hook that prefixes its messages with the
+// given target name, so that the output of targets being built at the
+// same time can be told apart.
+func (h *UIHook) ForTarget(name string) terraform.Hook {
+	ret := *h
+	ret.target = name
+	return &ret
+}
+
+func (h *UIHook) prefix() string {
+	if h.target == "" {
+		return ""
+	}
+	return h.target + ": "
 }
 
 func (h *UIHook) PreApply(instance *terraform.InstanceInfo, istate *terraform.InstanceState, diff *terraform.InstanceDiff) (terraform.HookAction, error) {
 	if diff.Destroy || diff.DestroyTainted {
-		h.ui.Info(fmt.Sprintf("[%v] Destroying ...", instance.HumanId()))
+		h.ui.Info(fmt.Sprintf("%s[%v] Destroying ...", h.prefix(), instance.HumanId()))
 	} else {
-		h.ui.Info(fmt.Sprintf("[%v] Creating...", instance.HumanId()))
+		h.ui.Info(fmt.Sprintf("%s[%v] Creating...", h.prefix(), instance.HumanId()))
 	}
 	return terraform.HookActionContinue, nil
 }
 
 func (h *UIHook) PostApply(instance *terraform.InstanceInfo, istate *terraform.InstanceState, err error) (terraform.HookAction, error) {
 	if err != nil {
-		h.ui.Error(fmt.Sprintf("[%v] Error during apply: %v", instance.HumanId(), err.Error()))
+		h.ui.Error(fmt.Sprintf("%s[%v] Error during apply: %v", h.prefix(), instance.HumanId(), err.Error()))
 	} else {
 		if h.verbose {
 			if istate.ID != "" {
-				h.ui.Info(fmt.Sprintf("[%v] Successfully created as %v", instance.HumanId(), istate.ID))
+				h.ui.Info(fmt.Sprintf("%s[%v] Successfully created as %v", h.prefix(), instance.HumanId(), istate.ID))
 			} else {
-				h.ui.Info(fmt.Sprintf("[%v] Successfully destroyed", instance.HumanId()))
+				h.ui.Info(fmt.Sprintf("%s[%v] Successfully destroyed", h.prefix(), instance.HumanId()))
 			}
 		}
 	}
@@ -38,17 +55,17 @@ func (h *UIHook) PostApply(instance *terraform.InstanceInfo, istate *terraform.I
 }
 
 func (h *UIHook) PreProvisionResource(instance *terraform.InstanceInfo, istate *terraform.InstanceState) (terraform.HookAction, error) {
-	h.ui.Info(fmt.Sprintf("[%v] Provisioning...", instance.HumanId()))
+	h.ui.Info(fmt.Sprintf("%s[%v] Provisioning...", h.prefix(), instance.HumanId()))
 	return terraform.HookActionContinue, nil
 }
 
 func (h *UIHook) PostProvisionResource(instance *terraform.InstanceInfo, istate *terraform.InstanceState) (terraform.HookAction, error) {
 	if h.verbose {
-		h.ui.Info(fmt.Sprintf("[%v] Successfully provisioned", instance.HumanId()))
+		h.ui.Info(fmt.Sprintf("%s[%v] Successfully provisioned", h.prefix(), instance.HumanId()))
 	}
 	return terraform.HookActionContinue, nil
 }
 
 func (h *UIHook) ProvisionOutput(instance *terraform.InstanceInfo, name string, line string) {
-	h.ui.Info(fmt.Sprintf("[%v %v] %v", instance.HumanId(), name, line))
+	h.ui.Info(fmt.Sprintf("%s[%v %v] %v", h.prefix(), instance.HumanId(), name, line))
 }
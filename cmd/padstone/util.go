@@ -2,7 +2,13 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"os/user"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/apparentlymart/padstone/padstone"
 )
 
 func decodeKVSpecs(specs []string) (map[string]string, error) {
@@ -18,3 +24,82 @@ func decodeKVSpecs(specs []string) (map[string]string, error) {
 	}
 	return ret, nil
 }
+
+// legacyStateArgs supports the form of the destroy and cleanup commands
+// taken by earlier versions, whose first argument was the configuration
+// directory, followed by the state file. Given the --config option and the
+// positional arguments, it returns the configuration path, state file and
+// variable specifications to use.
+//
+// A state file is never a directory, so a first argument that is one must
+// be a configuration directory given in the earlier form.
+func legacyStateArgs(configPath, first string, rest []string) (string, string, []string) {
+	if configPath != "" || len(rest) == 0 {
+		return configPath, first, rest
+	}
+	info, err := os.Stat(first)
+	if err != nil || !info.IsDir() {
+		return configPath, first, rest
+	}
+	return first, rest[0], rest[1:]
+}
+
+// currentUser returns the name of the user running padstone, or an empty
+// string if it cannot be determined.
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// parseAge parses an age given on the command line. As well as the units
+// accepted by time.ParseDuration it accepts whole numbers of days and
+// weeks, such as "7d" or "2w".
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(s, suffix))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%q is not a valid age", s)
+		}
+		return time.Duration(n) * unit, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// formatAge returns the given age rounded to the largest two units, such
+// as "3d4h" or "12m".
+func formatAge(d time.Duration) string {
+	day := 24 * time.Hour
+	switch {
+	case d >= day:
+		return fmt.Sprintf("%dd%dh", d/day, (d%day)/time.Hour)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", d/time.Hour, (d%time.Hour)/time.Minute)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	default:
+		return fmt.Sprintf("%ds", d/time.Second)
+	}
+}
+
+// checkConfig reports any problems that Config.Validate finds in the given
+// configuration, returning an error if any of them are errors. Commands
+// call it before building the target graph, so that mistakes in the target
+// structure are reported with their positions.
+func checkConfig(ui *UI, config *padstone.Config) error {
+	diags := config.Validate()
+	for _, diag := range diags.Warnings() {
+		ui.Warn(diag.Error())
+	}
+	if diags.HasErrors() {
+		for _, diag := range diags.Errors() {
+			ui.Error(diag.Error())
+		}
+		return fmt.Errorf("aborted due to configuration errors.")
+	}
+	return nil
+}
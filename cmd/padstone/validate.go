@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/apparentlymart/padstone/padstone"
+
+	getter "github.com/hashicorp/go-getter"
+	tfcmd "github.com/hashicorp/terraform/command"
+)
+
+type ValidateCommand struct {
+	ui    *UI
+	input *tfcmd.UIInput
+
+	Args ValidateCommandArgs `positional-args:"true" required:"true"`
+}
+
+type ValidateCommandArgs struct {
+	ConfigDir string   `positional-arg-name:"config-dir" description:"path to the directory containing the build configuration"`
+	VarSpecs  []string `positional-args:"true" positional-arg-name:"varname=value" description:"zero or more explicit variable value specifications"`
+}
+
+func (c *ValidateCommand) Execute(args []string) error {
+	sysConfig := BuiltinConfig
+	sysConfig.Discover()
+
+	config, err := padstone.LoadConfig(c.Args.ConfigDir)
+	if err != nil {
+		if diags, ok := err.(padstone.Diagnostics); ok {
+			c.reportDiagnostics(diags)
+			return fmt.Errorf("configuration is invalid")
+		}
+		return err
+	}
+
+	variables, err := decodeKVSpecs(c.Args.VarSpecs)
+	if err != nil {
+		return err
+	}
+
+	// Validation doesn't create anything, so there are no hooks and no
+	// state, and any variables not given are treated as unknown rather
+	// than prompted for.
+	ctx := &padstone.Context{
+		Config:       config,
+		Providers:    sysConfig.ProviderFactories(),
+		Provisioners: sysConfig.ProvisionerFactories(),
+		Variables:    variables,
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: ".padstone",
+		},
+	}
+
+	diags := ctx.Validate()
+	c.reportDiagnostics(diags)
+
+	if diags.HasErrors() {
+		return fmt.Errorf("configuration is invalid")
+	}
+
+	c.ui.Info("Configuration is valid.")
+	return nil
+}
+
+// reportDiagnostics prints the given diagnostics, with those that relate
+// to a particular target grouped under that target's name.
+func (c *ValidateCommand) reportDiagnostics(diags padstone.Diagnostics) {
+	byTarget := make(map[string]padstone.Diagnostics)
+	var targetNames []string
+	for _, diag := range diags {
+		if _, exists := byTarget[diag.Target]; !exists && diag.Target != "" {
+			targetNames = append(targetNames, diag.Target)
+		}
+		byTarget[diag.Target] = append(byTarget[diag.Target], diag)
+	}
+
+	for _, diag := range byTarget[""] {
+		c.reportDiagnostic(diag, "")
+	}
+
+	for _, name := range targetNames {
+		c.ui.Output(fmt.Sprintf("\nTarget %s:", name))
+		for _, diag := range byTarget[name] {
+			// The heading already names the target.
+			untargeted := *diag
+			untargeted.Target = ""
+			c.reportDiagnostic(&untargeted, "  ")
+		}
+	}
+}
+
+func (c *ValidateCommand) reportDiagnostic(diag *padstone.Diagnostic, indent string) {
+	switch diag.Severity {
+	case padstone.DiagnosticWarning:
+		c.ui.Warn(fmt.Sprintf("%sWarning: %s", indent, diag.Error()))
+	default:
+		c.ui.Error(fmt.Sprintf("%sError: %s", indent, diag.Error()))
+	}
+}
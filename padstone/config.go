@@ -1,11 +1,20 @@
 package padstone
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl"
 	"github.com/hashicorp/hcl/hcl/ast"
+	hclparser "github.com/hashicorp/hcl/hcl/parser"
+	"github.com/hashicorp/hcl/hcl/token"
+	"github.com/mitchellh/mapstructure"
 
 	tfcfg "github.com/hashicorp/terraform/config"
 	tfmod "github.com/hashicorp/terraform/config/module"
@@ -17,9 +26,28 @@ type Config struct {
 	// an on-disk file.
 	SourceFilename string
 
+	// SourceDir is the path to the directory from which this configuration
+	// was loaded, if it was loaded from a directory rather than a single
+	// file.
+	SourceDir string
+
 	Variables []*tfcfg.Variable
 	Targets   []*TargetConfig
 	Providers []*tfcfg.ProviderConfig
+
+	// DefaultBuildTargets and DefaultDevTargets are the names of the
+	// targets that are built when no targets are explicitly selected,
+	// for normal builds and development builds respectively.
+	DefaultBuildTargets []string
+	DefaultDevTargets   []string
+
+	// BuildTTL is how long the results of a build remain before they
+	// expire and may be garbage collected, or zero if they never expire.
+	BuildTTL time.Duration
+
+	// positions records where each of the declarations in the
+	// configuration was parsed from, for use in diagnostics.
+	positions configPositions
 }
 
 type TargetConfig struct {
@@ -31,7 +59,55 @@ type TargetConfig struct {
 	Outputs   []*tfcfg.Output
 }
 
-func LoadConfig(filename string) (*Config, error) {
+// LoadConfig loads the configuration at the given path, which may either
+// be a single configuration file or a directory of configuration files.
+func LoadConfig(path string) (*Config, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return LoadConfigDir(path)
+	}
+
+	return LoadConfigFile(path)
+}
+
+// ConfigHash returns a hash of the configuration at the given path, which
+// may be either a file or a directory as for LoadConfig. The hash changes
+// if any of the files that LoadConfig would read are changed, added or
+// removed.
+func ConfigHash(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		var overrides []string
+		files, overrides, err = configDirFiles(path)
+		if err != nil {
+			return "", err
+		}
+		files = append(files, overrides...)
+	}
+
+	h := sha256.New()
+	for _, filename := range files {
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.Base(filename), len(content))
+		h.Write(content)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// LoadConfigFile loads the configuration from a single file.
+func LoadConfigFile(filename string) (*Config, error) {
 	configBytes, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return nil, err
@@ -40,50 +116,207 @@ func LoadConfig(filename string) (*Config, error) {
 	return ParseConfig(configBytes, filename)
 }
 
+// ParseConfig parses the given configuration source, which may be in
+// either the native HCL syntax or the equivalent JSON syntax.
+//
+// If the configuration has any problems, the returned error is of type
+// Diagnostics and describes all of them.
 func ParseConfig(configBytes []byte, filename string) (*Config, error) {
+	config, diags := parseConfig(configBytes, filename)
+	if diags.HasErrors() {
+		return nil, diags.Err()
+	}
+
+	diags = config.checkDefaultTargets()
+	if diags.HasErrors() {
+		return nil, diags.Err()
+	}
+
+	return config, nil
+}
+
+// NewConfigFromHCL is like ParseConfig but takes an already-parsed HCL
+// AST.
+func NewConfigFromHCL(hclConfig *ast.ObjectList, filename string) (*Config, error) {
+	config, diags := newConfigFromHCL(hclConfig, filename)
+	if diags.HasErrors() {
+		return nil, diags.Err()
+	}
+
+	diags = config.checkDefaultTargets()
+	if diags.HasErrors() {
+		return nil, diags.Err()
+	}
+
+	return config, nil
+}
+
+// parseConfig is like ParseConfig except that it does not check that the
+// configuration is complete, since a file in a configuration directory may
+// refer to targets declared in other files.
+func parseConfig(configBytes []byte, filename string) (*Config, Diagnostics) {
 	rawConfigFile, err := hcl.Parse(string(configBytes))
 	if err != nil {
-		return nil, err
+		diag := &Diagnostic{
+			Severity: DiagnosticError,
+			Message:  err.Error(),
+			Filename: filename,
+		}
+		if posErr, ok := err.(*hclparser.PosError); ok {
+			diag.Message = posErr.Err.Error()
+			diag.Line = posErr.Pos.Line
+			diag.Column = posErr.Pos.Column
+		}
+		return nil, Diagnostics{diag}
+	}
+
+	rawConfig, ok := rawConfigFile.Node.(*ast.ObjectList)
+	if !ok {
+		return nil, Diagnostics{
+			&Diagnostic{
+				Severity: DiagnosticError,
+				Message:  "configuration must be an object",
+				Filename: filename,
+			},
+		}
 	}
 
-	rawConfig := rawConfigFile.Node
-	return NewConfigFromHCL(rawConfig.(*ast.ObjectList), filename)
+	return newConfigFromHCL(rawConfig, filename)
 }
 
-func NewConfigFromHCL(hclConfig *ast.ObjectList, filename string) (*Config, error) {
+// newConfigFromHCL builds a configuration from the given HCL AST, returning
+// diagnostics for all of the problems it finds. The configuration is
+// returned even if there are errors, but in that case it is incomplete.
+func newConfigFromHCL(hclConfig *ast.ObjectList, filename string) (*Config, Diagnostics) {
 	config := &Config{
 		SourceFilename: filename,
+		positions:      make(configPositions),
 	}
 
-	var err error
+	var diags, moreDiags Diagnostics
 
-	config.Variables, err = loadConfigVariables(hclConfig.Filter("variable"))
-	if err != nil {
-		return nil, err
+	config.Variables, moreDiags = loadConfigVariables(hclConfig.Filter("variable"), config.positions)
+	diags = append(diags, moreDiags...)
+
+	config.Providers, moreDiags = loadConfigProviders(hclConfig.Filter("provider"), config.positions, "")
+	diags = append(diags, moreDiags...)
+
+	config.Targets, moreDiags = loadConfigTargets(hclConfig.Filter("target"), config.positions)
+	diags = append(diags, moreDiags...)
+
+	config.DefaultBuildTargets, moreDiags = loadConfigTargetNames(hclConfig.Filter("default_build_targets"), "default_build_targets", config.positions)
+	diags = append(diags, moreDiags...)
+
+	config.DefaultDevTargets, moreDiags = loadConfigTargetNames(hclConfig.Filter("default_dev_targets"), "default_dev_targets", config.positions)
+	diags = append(diags, moreDiags...)
+
+	config.BuildTTL, moreDiags = loadConfigDuration(hclConfig.Filter("build_ttl"), "build_ttl", config.positions)
+	diags = append(diags, moreDiags...)
+
+	diags.setFilename(filename)
+	config.positions.setFilename(filename)
+	return config, diags
+}
+
+// checkDefaultTargets returns an error diagnostic for each name in the
+// default target lists that does not refer to a declared target.
+func (c *Config) checkDefaultTargets() Diagnostics {
+	lists := []struct {
+		attrName string
+		names    []string
+	}{
+		{"default_build_targets", c.DefaultBuildTargets},
+		{"default_dev_targets", c.DefaultDevTargets},
 	}
 
-	config.Providers, err = loadConfigProviders(hclConfig.Filter("provider"))
-	if err != nil {
-		return nil, err
+	var diags Diagnostics
+	for _, list := range lists {
+		for _, name := range list.names {
+			if c.Target(name) == nil {
+				diag := diagErrorf(
+					c.declPos(list.attrName, 0),
+					"%s refers to undeclared target %s", list.attrName, name,
+				)
+				if diag.Filename == "" {
+					diag.Filename = c.SourceFilename
+				}
+				diags = append(diags, diag)
+			}
+		}
 	}
 
-	config.Targets, err = loadConfigTargets(hclConfig.Filter("target"))
-	if err != nil {
-		return nil, err
+	return diags
+}
+
+// DefaultTargets returns the names of the targets that should be kept
+// when the caller doesn't select any targets explicitly.
+//
+// For normal builds this is the configured default_build_targets, or all
+// of the targets if that isn't set. For development builds it is the
+// configured default_dev_targets, which must be set.
+func (c *Config) DefaultTargets(dev bool) ([]string, error) {
+	if dev {
+		if len(c.DefaultDevTargets) == 0 {
+			return nil, fmt.Errorf("configuration does not set default_dev_targets")
+		}
+		return c.DefaultDevTargets, nil
 	}
 
-	return config, nil
+	if len(c.DefaultBuildTargets) == 0 {
+		ret := make([]string, len(c.Targets))
+		for i, target := range c.Targets {
+			ret[i] = target.Name
+		}
+		return ret, nil
+	}
+
+	return c.DefaultBuildTargets, nil
 }
 
-func (c *Config) TargetModuleTrees() map[string]*tfmod.Tree {
+// Target returns the configuration of the target with the given name, or
+// nil if there is no such target.
+func (c *Config) Target(name string) *TargetConfig {
+	for _, target := range c.Targets {
+		if target.Name == name {
+			return target
+		}
+	}
+	return nil
+}
+
+// TargetModuleTrees returns a Terraform module tree for each target,
+// keyed by target name.
+//
+// References to the outputs of other targets are replaced with references
+// to variables, which must then be populated using
+// TargetConfig.UpstreamVariables when creating a Terraform context for
+// the module tree.
+func (c *Config) TargetModuleTrees() (map[string]*tfmod.Tree, error) {
 	ret := make(map[string]*tfmod.Tree)
 
+	// Relative module sources are resolved relative to the directory
+	// containing the configuration.
+	dir := c.SourceDir
+	if dir == "" && c.SourceFilename != "" {
+		dir = filepath.Dir(c.SourceFilename)
+	}
+	if dir != "" {
+		var err error
+		dir, err = filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	type providerKey struct {
 		Name  string
 		Alias string
 	}
 
 	for _, target := range c.Targets {
+		if errs := target.checkTargetRefs(); len(errs) > 0 {
+			return nil, fmt.Errorf("target %s: %s", target.Name, errs[0])
+		}
 
 		// Build a per-target module configuration set by starting with
 		// the global configs and then letting the target configs override
@@ -114,6 +347,7 @@ func (c *Config) TargetModuleTrees() map[string]*tfmod.Tree {
 		}
 
 		tfConfig := &tfcfg.Config{
+			Dir:             dir,
 			Variables:       c.Variables,
 			Modules:         target.Modules,
 			Resources:       target.Resources,
@@ -121,209 +355,432 @@ func (c *Config) TargetModuleTrees() map[string]*tfmod.Tree {
 			ProviderConfigs: flatProviders,
 		}
 
+		if refs := target.TargetOutputRefs(); len(refs) > 0 {
+			var err error
+			tfConfig, err = rewriteTargetConfig(tfConfig, refs)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"error preparing target %s: %s", target.Name, err,
+				)
+			}
+		}
+
 		ret[target.Name] = tfmod.NewTree("", tfConfig)
 	}
 
-	return ret
+	return ret, nil
 }
 
-func loadConfigVariables(hclConfig *ast.ObjectList) ([]*tfcfg.Variable, error) {
-	hclConfig = hclConfig.Children()
-	result := make([]*tfcfg.Variable, 0, len(hclConfig.Items))
+// configPositions records the positions of the declarations in a
+// configuration, keyed by descriptions like "target a output id" as used in
+// diagnostics. Something that is declared more than once has a position
+// for each of its declarations, in the order they were parsed.
+type configPositions map[string][]token.Pos
 
-	if len(hclConfig.Items) == 0 {
-		return result, nil
-	}
+// record adds the position of a declaration of the thing with the given
+// description.
+func (p configPositions) record(what string, pos token.Pos) {
+	p[what] = append(p[what], pos)
+}
 
-	for _, item := range hclConfig.Items {
-		n := item.Keys[0].Token.Value().(string)
+// add adds all of the positions recorded in other, after any that are
+// already recorded for the same things.
+func (p configPositions) add(other configPositions) {
+	for what, positions := range other {
+		p[what] = append(p[what], positions...)
+	}
+}
 
-		var listVal *ast.ObjectList
-		if ot, ok := item.Val.(*ast.ObjectType); ok {
-			listVal = ot.List
-		} else {
-			return nil, fmt.Errorf("variable '%s': should be a block", n)
+// setFilename sets the filename of all of the recorded positions, which
+// the HCL parser leaves empty.
+func (p configPositions) setFilename(filename string) {
+	for _, positions := range p {
+		for i := range positions {
+			positions[i].Filename = filename
 		}
+	}
+}
 
-		var config map[string]interface{}
-		if err := hcl.DecodeObject(&config, item.Val); err != nil {
-			return nil, err
-		}
+// declPos returns the position of the nth declaration of the thing with
+// the given description, or of its first declaration if there are fewer
+// than n+1 of them. The position is the zero value if none was recorded,
+// such as for a configuration that was not parsed from a file.
+func (c *Config) declPos(what string, n int) token.Pos {
+	positions := c.positions[what]
+	switch {
+	case n < len(positions):
+		return positions[n]
+	case len(positions) > 0:
+		return positions[0]
+	default:
+		return token.Pos{}
+	}
+}
 
-		variable := &tfcfg.Variable{
-			Name: n,
-		}
-		if a := listVal.Filter("default"); len(a.Items) > 0 {
-			err := hcl.DecodeObject(&variable.Default, a.Items[0].Val)
-			if err != nil {
-				return nil, fmt.Errorf(
-					"error reading variable %s default: %s", n, err,
-				)
-			}
+// targetDeclKey returns the description used to record the position of the
+// given declaration within the target with the given name, or of a global
+// declaration if targetName is empty.
+func targetDeclKey(targetName string, what string) string {
+	if targetName == "" {
+		return what
+	}
+	return "target " + targetName + " " + what
+}
+
+// configItemPos returns the position of the given item, which is the
+// position of its first key if it still has one, or of its value otherwise.
+func configItemPos(item *ast.ObjectItem) token.Pos {
+	if len(item.Keys) > 0 {
+		return item.Keys[0].Pos()
+	}
+	return item.Val.Pos()
+}
+
+// configBlock checks that the given item is a block with the expected
+// number of labels, returning the labels and the block body. The labels
+// are described by labelsDesc for use in error messages, e.g. "a name".
+//
+// If the item is not a valid block, the returned diagnostics describe why
+// and the caller should skip the item.
+func configBlock(item *ast.ObjectItem, blockType string, numLabels int, labelsDesc string) ([]string, *ast.ObjectList, Diagnostics) {
+	unwrapJSONObjectKeys(item, numLabels)
+
+	if len(item.Keys) != numLabels {
+		return nil, nil, Diagnostics{
+			diagErrorf(configItemPos(item), "%s block must have %s", blockType, labelsDesc),
 		}
-		if a := listVal.Filter("description"); len(a.Items) > 0 {
-			err := hcl.DecodeObject(&variable.Description, a.Items[0].Val)
-			if err != nil {
-				return nil, fmt.Errorf(
-					"error reading variable %s description: %s", n, err,
-				)
+	}
+
+	labels := make([]string, numLabels)
+	for i, key := range item.Keys {
+		label, ok := key.Token.Value().(string)
+		if !ok {
+			return nil, nil, Diagnostics{
+				diagErrorf(key.Pos(), "%s block labels must be strings", blockType),
 			}
 		}
-		if a := listVal.Filter("type"); len(a.Items) > 0 {
-			err := hcl.DecodeObject(&variable.DeclaredType, a.Items[0].Val)
-			if err != nil {
-				return nil, fmt.Errorf(
-					"error reading variable %s type: %s", n, err,
-				)
-			}
+		labels[i] = label
+	}
+
+	ot, ok := item.Val.(*ast.ObjectType)
+	if !ok {
+		return nil, nil, Diagnostics{
+			diagErrorf(configItemPos(item), "%s '%s': should be a block", blockType, strings.Join(labels, ".")),
 		}
+	}
 
-		result = append(result, variable)
+	return labels, ot.List, nil
+}
+
+// decodeConfigAttr decodes the last of the attributes with the given name
+// in the given block body, if any, into the given value. Any problem is
+// reported as a diagnostic whose message begins with what.
+func decodeConfigAttr(listVal *ast.ObjectList, name string, out interface{}, what string) Diagnostics {
+	a := listVal.Filter(name)
+	if len(a.Items) == 0 {
+		return nil
 	}
 
-	return result, nil
+	item := a.Items[len(a.Items)-1]
+	if err := hcl.DecodeObject(out, item.Val); err != nil {
+		return Diagnostics{
+			diagErrorf(item.Val.Pos(), "error reading %s: %s", what, err),
+		}
+	}
+
+	return nil
 }
 
-func loadConfigProviders(hclConfig *ast.ObjectList) ([]*tfcfg.ProviderConfig, error) {
-	hclConfig = hclConfig.Children()
-	result := make([]*tfcfg.ProviderConfig, 0, len(hclConfig.Items))
+// decodeConfigBody decodes the whole of the given block into a map and
+// builds a raw config from it, after removing the given meta-arguments
+// that are handled separately.
+func decodeConfigBody(item *ast.ObjectItem, what string, remove ...string) (map[string]interface{}, *tfcfg.RawConfig, Diagnostics) {
+	var config map[string]interface{}
+	if err := hcl.DecodeObject(&config, item.Val); err != nil {
+		return nil, nil, Diagnostics{
+			diagErrorf(configItemPos(item), "error reading %s: %s", what, err),
+		}
+	}
 
-	if len(hclConfig.Items) == 0 {
-		return result, nil
+	for _, k := range remove {
+		delete(config, k)
 	}
 
-	for _, item := range hclConfig.Items {
-		n := item.Keys[0].Token.Value().(string)
+	rawConfig, err := tfcfg.NewRawConfig(config)
+	if err != nil {
+		return nil, nil, Diagnostics{
+			diagErrorf(configItemPos(item), "error reading %s: %s", what, err),
+		}
+	}
 
-		var listVal *ast.ObjectList
-		if ot, ok := item.Val.(*ast.ObjectType); ok {
-			listVal = ot.List
-		} else {
-			return nil, fmt.Errorf("provider '%s': should be a block", n)
+	return config, rawConfig, nil
+}
+
+func loadConfigVariables(hclConfig *ast.ObjectList, positions configPositions) ([]*tfcfg.Variable, Diagnostics) {
+	result := make([]*tfcfg.Variable, 0, len(hclConfig.Items))
+	var diags Diagnostics
+
+	for _, item := range expandJSONBlockItems(hclConfig, 1).Items {
+		labels, listVal, blockDiags := configBlock(item, "variable", 1, "a name")
+		if len(blockDiags) > 0 {
+			diags = append(diags, blockDiags...)
+			continue
 		}
+		n := labels[0]
+		positions.record("variable "+n, configItemPos(item))
 
-		var config map[string]interface{}
-		if err := hcl.DecodeObject(&config, item.Val); err != nil {
-			return nil, err
+		variable := &tfcfg.Variable{
+			Name: n,
 		}
+		diags = append(diags, decodeConfigAttr(
+			listVal, "default", &variable.Default,
+			fmt.Sprintf("variable %s default", n),
+		)...)
+		diags = append(diags, decodeConfigAttr(
+			listVal, "description", &variable.Description,
+			fmt.Sprintf("variable %s description", n),
+		)...)
+		diags = append(diags, decodeConfigAttr(
+			listVal, "type", &variable.DeclaredType,
+			fmt.Sprintf("variable %s type", n),
+		)...)
 
-		delete(config, "alias")
+		result = append(result, variable)
+	}
 
-		rawConfig, err := tfcfg.NewRawConfig(config)
-		if err != nil {
-			return nil, fmt.Errorf(
-				"error reading provider config %s: %s", n, err,
-			)
+	return result, diags
+}
+
+func loadConfigProviders(hclConfig *ast.ObjectList, positions configPositions, targetName string) ([]*tfcfg.ProviderConfig, Diagnostics) {
+	result := make([]*tfcfg.ProviderConfig, 0, len(hclConfig.Items))
+	var diags Diagnostics
+
+	for _, item := range expandJSONBlockItems(hclConfig, 1).Items {
+		labels, listVal, blockDiags := configBlock(item, "provider", 1, "a name")
+		if len(blockDiags) > 0 {
+			diags = append(diags, blockDiags...)
+			continue
+		}
+		n := labels[0]
+
+		_, rawConfig, bodyDiags := decodeConfigBody(
+			item, fmt.Sprintf("provider config %s", n), "alias",
+		)
+		if len(bodyDiags) > 0 {
+			diags = append(diags, bodyDiags...)
+			continue
 		}
 
 		// If we have an alias, add it in
 		var alias string
-		if a := listVal.Filter("alias"); len(a.Items) > 0 {
-			err := hcl.DecodeObject(&alias, a.Items[0].Val)
-			if err != nil {
-				return nil, fmt.Errorf(
-					"error reading provider %s alias: %s", n, err,
-				)
-			}
-		}
+		diags = append(diags, decodeConfigAttr(
+			listVal, "alias", &alias,
+			fmt.Sprintf("provider %s alias", n),
+		)...)
 
-		result = append(result, &tfcfg.ProviderConfig{
+		provider := &tfcfg.ProviderConfig{
 			Name:      n,
 			Alias:     alias,
 			RawConfig: rawConfig,
-		})
+		}
+		positions.record(targetDeclKey(targetName, "provider "+provider.FullName()), configItemPos(item))
+		result = append(result, provider)
 	}
 
-	return result, nil
+	return result, diags
 }
 
-func loadConfigTargets(hclConfig *ast.ObjectList) ([]*TargetConfig, error) {
-	hclConfig = hclConfig.Children()
+func loadConfigTargets(hclConfig *ast.ObjectList, positions configPositions) ([]*TargetConfig, Diagnostics) {
+	hclConfig = joinJSONTargetItems(expandJSONBlockItems(hclConfig, 1))
 	result := make([]*TargetConfig, 0, len(hclConfig.Items))
-
-	if len(hclConfig.Items) == 0 {
-		return result, nil
-	}
+	var diags Diagnostics
 
 	for _, item := range hclConfig.Items {
-		n := item.Keys[0].Token.Value().(string)
-
-		var listVal *ast.ObjectList
-		if ot, ok := item.Val.(*ast.ObjectType); ok {
-			listVal = ot.List
-		} else {
-			return nil, fmt.Errorf("target '%s': should be a block", n)
+		labels, listVal, blockDiags := configBlock(item, "target", 1, "a name")
+		if len(blockDiags) > 0 {
+			diags = append(diags, blockDiags...)
+			continue
 		}
 
 		target := &TargetConfig{
-			Name: n,
+			Name: labels[0],
 		}
+		positions.record("target "+target.Name, configItemPos(item))
 
-		var err error
+		var moreDiags Diagnostics
 
-		target.Providers, err = loadConfigProviders(listVal.Filter("provider"))
-		if err != nil {
-			return nil, err
+		target.Providers, moreDiags = loadConfigProviders(listVal.Filter("provider"), positions, target.Name)
+		diags = append(diags, moreDiags...)
+
+		target.Modules, moreDiags = loadConfigModules(listVal.Filter("module"), positions, target.Name)
+		diags = append(diags, moreDiags...)
+
+		dataResources, moreDiags := loadConfigDataResources(listVal.Filter("data"), positions, target.Name)
+		diags = append(diags, moreDiags...)
+
+		managedResources, moreDiags := loadConfigManagedResources(listVal.Filter("resource"), positions, target.Name)
+		diags = append(diags, moreDiags...)
+
+		target.Resources = make(
+			[]*tfcfg.Resource, 0,
+			len(dataResources)+len(managedResources),
+		)
+		target.Resources = append(target.Resources, dataResources...)
+		target.Resources = append(target.Resources, managedResources...)
+
+		target.Outputs, moreDiags = loadConfigOutputs(listVal.Filter("output"), positions, target.Name)
+		diags = append(diags, moreDiags...)
+
+		for _, err := range target.checkTargetRefs() {
+			diag := diagErrorf(configItemPos(item), "%s", err)
+			diag.Target = target.Name
+			diags = append(diags, diag)
 		}
 
-		target.Modules, err = loadConfigModules(listVal.Filter("module"))
-		if err != nil {
-			return nil, err
+		result = append(result, target)
+	}
+
+	return result, diags
+}
+
+// joinJSONTargetItems undoes the flattening of target blocks written in
+// JSON, where the HCL parser splits a single target object into a separate
+// item for each block inside it, with the target name as the first key.
+// Items for the same target are joined back into a single block, in the
+// order that each target first appears.
+func joinJSONTargetItems(hclConfig *ast.ObjectList) *ast.ObjectList {
+	result := &ast.ObjectList{}
+	blocks := make(map[string]*ast.ObjectType)
+
+	for _, item := range hclConfig.Items {
+		if len(item.Keys) == 0 || !item.Keys[0].Token.JSON {
+			result.Add(item)
+			continue
+		}
+		key := item.Keys[0]
+
+		var items []*ast.ObjectItem
+		if len(item.Keys) > 1 {
+			items = []*ast.ObjectItem{
+				{
+					Keys: item.Keys[1:],
+					Val:  item.Val,
+				},
+			}
+		} else if ot, ok := item.Val.(*ast.ObjectType); ok {
+			items = ot.List.Items
+		} else {
+			result.Add(item)
+			continue
 		}
 
-		target.Outputs, err = loadConfigOutputs(listVal.Filter("output"))
-		if err != nil {
-			return nil, err
+		n, ok := key.Token.Value().(string)
+		if !ok {
+			result.Add(item)
+			continue
+		}
+		if block, exists := blocks[n]; exists {
+			block.List.Items = append(block.List.Items, items...)
+			continue
 		}
 
-		result = append(result, target)
+		block := &ast.ObjectType{
+			List: &ast.ObjectList{
+				Items: append([]*ast.ObjectItem{}, items...),
+			},
+		}
+		blocks[n] = block
+		result.Add(&ast.ObjectItem{
+			Keys: []*ast.ObjectKey{key},
+			Val:  block,
+		})
 	}
 
-	return result, nil
+	return result
 }
 
-func loadConfigModules(hclConfig *ast.ObjectList) ([]*tfcfg.Module, error) {
-	hclConfig = hclConfig.Children()
-	result := make([]*tfcfg.Module, 0, len(hclConfig.Items))
+func loadConfigTargetNames(hclConfig *ast.ObjectList, attrName string, positions configPositions) ([]string, Diagnostics) {
+	if len(hclConfig.Items) == 0 {
+		return nil, nil
+	}
+
+	var diags Diagnostics
+	for _, item := range hclConfig.Items[1:] {
+		diags = append(diags, diagErrorf(configItemPos(item), "%s may only be set once", attrName))
+	}
+
+	item := hclConfig.Items[0]
+	if len(item.Keys) > 0 {
+		return nil, append(diags, diagErrorf(configItemPos(item), "%s must be a list of target names", attrName))
+	}
+	positions.record(attrName, item.Val.Pos())
+
+	var names []string
+	err := hcl.DecodeObject(&names, item.Val)
+	if err != nil {
+		return nil, append(diags, diagErrorf(item.Val.Pos(), "error reading %s: %s", attrName, err))
+	}
+
+	return names, diags
+}
 
+func loadConfigDuration(hclConfig *ast.ObjectList, attrName string, positions configPositions) (time.Duration, Diagnostics) {
 	if len(hclConfig.Items) == 0 {
-		return result, nil
+		return 0, nil
 	}
 
-	for _, item := range hclConfig.Items {
-		n := item.Keys[0].Token.Value().(string)
+	var diags Diagnostics
+	for _, item := range hclConfig.Items[1:] {
+		diags = append(diags, diagErrorf(configItemPos(item), "%s may only be set once", attrName))
+	}
 
-		var listVal *ast.ObjectList
-		if ot, ok := item.Val.(*ast.ObjectType); ok {
-			listVal = ot.List
-		} else {
-			return nil, fmt.Errorf("module '%s': should be a block", n)
-		}
+	item := hclConfig.Items[0]
+	if len(item.Keys) > 0 {
+		return 0, append(diags, diagErrorf(configItemPos(item), "%s must be a duration, such as \"72h\"", attrName))
+	}
+	positions.record(attrName, item.Val.Pos())
 
-		var config map[string]interface{}
-		if err := hcl.DecodeObject(&config, item.Val); err != nil {
-			return nil, err
-		}
+	var str string
+	err := hcl.DecodeObject(&str, item.Val)
+	if err != nil {
+		return 0, append(diags, diagErrorf(item.Val.Pos(), "error reading %s: %s", attrName, err))
+	}
 
-		delete(config, "source")
+	d, err := time.ParseDuration(str)
+	if err != nil || d < 0 {
+		return 0, append(diags, diagErrorf(item.Val.Pos(), "%s must be a duration, such as \"72h\"", attrName))
+	}
 
-		rawConfig, err := tfcfg.NewRawConfig(config)
-		if err != nil {
-			return nil, fmt.Errorf(
-				"error reading module config %s: %s", n, err,
-			)
+	return d, diags
+}
+
+func loadConfigModules(hclConfig *ast.ObjectList, positions configPositions, targetName string) ([]*tfcfg.Module, Diagnostics) {
+	result := make([]*tfcfg.Module, 0, len(hclConfig.Items))
+	var diags Diagnostics
+
+	for _, item := range expandJSONBlockItems(hclConfig, 1).Items {
+		labels, listVal, blockDiags := configBlock(item, "module", 1, "a name")
+		if len(blockDiags) > 0 {
+			diags = append(diags, blockDiags...)
+			continue
+		}
+		n := labels[0]
+
+		_, rawConfig, bodyDiags := decodeConfigBody(
+			item, fmt.Sprintf("module config %s", n), "source",
+		)
+		if len(bodyDiags) > 0 {
+			diags = append(diags, bodyDiags...)
+			continue
 		}
 
 		var source string
-		if a := listVal.Filter("source"); len(a.Items) > 0 {
-			err := hcl.DecodeObject(&source, a.Items[0].Val)
-			if err != nil {
-				return nil, fmt.Errorf(
-					"error reading module %s source: %s", n, err,
-				)
-			}
-		}
+		diags = append(diags, decodeConfigAttr(
+			listVal, "source", &source,
+			fmt.Sprintf("module %s source", n),
+		)...)
 
+		positions.record(targetDeclKey(targetName, "module "+n), configItemPos(item))
 		result = append(result, &tfcfg.Module{
 			Name:      n,
 			Source:    source,
@@ -331,41 +788,362 @@ func loadConfigModules(hclConfig *ast.ObjectList) ([]*tfcfg.Module, error) {
 		})
 	}
 
-	return result, nil
+	return result, diags
 }
 
-func loadConfigOutputs(hclConfig *ast.ObjectList) ([]*tfcfg.Output, error) {
-	hclConfig = hclConfig.Children()
+func loadConfigOutputs(hclConfig *ast.ObjectList, positions configPositions, targetName string) ([]*tfcfg.Output, Diagnostics) {
 	result := make([]*tfcfg.Output, 0, len(hclConfig.Items))
+	var diags Diagnostics
 
-	if len(hclConfig.Items) == 0 {
-		return result, nil
+	for _, item := range expandJSONBlockItems(hclConfig, 1).Items {
+		labels, _, blockDiags := configBlock(item, "output", 1, "a name")
+		if len(blockDiags) > 0 {
+			diags = append(diags, blockDiags...)
+			continue
+		}
+		n := labels[0]
+
+		_, rawConfig, bodyDiags := decodeConfigBody(
+			item, fmt.Sprintf("output config %s", n),
+		)
+		if len(bodyDiags) > 0 {
+			diags = append(diags, bodyDiags...)
+			continue
+		}
+
+		positions.record(targetDeclKey(targetName, "output "+n), configItemPos(item))
+		result = append(result, &tfcfg.Output{
+			Name:      n,
+			RawConfig: rawConfig,
+		})
 	}
 
-	for _, item := range hclConfig.Items {
-		n := item.Keys[0].Token.Value().(string)
+	return result, diags
+}
 
-		if _, ok := item.Val.(*ast.ObjectType); !ok {
-			return nil, fmt.Errorf("output '%s': should be a block", n)
+func loadConfigDataResources(hclConfig *ast.ObjectList, positions configPositions, targetName string) ([]*tfcfg.Resource, Diagnostics) {
+	result := make([]*tfcfg.Resource, 0, len(hclConfig.Items))
+	var diags Diagnostics
+
+	for _, item := range expandJSONBlockItems(hclConfig, 2).Items {
+		labels, listVal, blockDiags := configBlock(item, "data", 2, "a type and a name")
+		if len(blockDiags) > 0 {
+			diags = append(diags, blockDiags...)
+			continue
+		}
+		t, n := labels[0], labels[1]
+
+		_, rawConfig, bodyDiags := decodeConfigBody(
+			item, fmt.Sprintf("data config %s.%s", t, n),
+			"count", "depends_on", "provider",
+		)
+		if len(bodyDiags) > 0 {
+			diags = append(diags, bodyDiags...)
+			continue
 		}
 
-		var config map[string]interface{}
-		if err := hcl.DecodeObject(&config, item.Val); err != nil {
-			return nil, err
+		countConfig, moreDiags := loadConfigResourceCount(listVal, t, n)
+		diags = append(diags, moreDiags...)
+
+		var dependsOn []string
+		diags = append(diags, decodeConfigAttr(
+			listVal, "depends_on", &dependsOn,
+			fmt.Sprintf("%s.%s depends_on", t, n),
+		)...)
+
+		var provider string
+		diags = append(diags, decodeConfigAttr(
+			listVal, "provider", &provider,
+			fmt.Sprintf("%s.%s provider", t, n),
+		)...)
+
+		positions.record(targetDeclKey(targetName, "resource data."+t+"."+n), configItemPos(item))
+		result = append(result, &tfcfg.Resource{
+			Mode:         tfcfg.DataResourceMode,
+			Name:         n,
+			Type:         t,
+			RawCount:     countConfig,
+			RawConfig:    rawConfig,
+			Provider:     provider,
+			Provisioners: []*tfcfg.Provisioner{},
+			DependsOn:    dependsOn,
+		})
+	}
+
+	return result, diags
+}
+
+func loadConfigManagedResources(hclConfig *ast.ObjectList, positions configPositions, targetName string) ([]*tfcfg.Resource, Diagnostics) {
+	result := make([]*tfcfg.Resource, 0, len(hclConfig.Items))
+	var diags Diagnostics
+
+	for _, item := range expandJSONBlockItems(hclConfig, 2).Items {
+		labels, listVal, blockDiags := configBlock(item, "resource", 2, "a type and a name")
+		if len(blockDiags) > 0 {
+			diags = append(diags, blockDiags...)
+			continue
+		}
+		t, n := labels[0], labels[1]
+
+		_, rawConfig, bodyDiags := decodeConfigBody(
+			item, fmt.Sprintf("resource config %s.%s", t, n),
+			"connection", "count", "depends_on", "lifecycle", "provider", "provisioner",
+		)
+		if len(bodyDiags) > 0 {
+			diags = append(diags, bodyDiags...)
+			continue
 		}
 
-		rawConfig, err := tfcfg.NewRawConfig(config)
+		countConfig, moreDiags := loadConfigResourceCount(listVal, t, n)
+		diags = append(diags, moreDiags...)
+
+		var dependsOn []string
+		diags = append(diags, decodeConfigAttr(
+			listVal, "depends_on", &dependsOn,
+			fmt.Sprintf("%s.%s depends_on", t, n),
+		)...)
+
+		var provider string
+		diags = append(diags, decodeConfigAttr(
+			listVal, "provider", &provider,
+			fmt.Sprintf("%s.%s provider", t, n),
+		)...)
+
+		// The resource-level connection block, if any, is the default
+		// for all of the provisioners, which may then override it.
+		var connInfo map[string]interface{}
+		diags = append(diags, decodeConfigAttr(
+			listVal, "connection", &connInfo,
+			fmt.Sprintf("resource %s.%s connection", t, n),
+		)...)
+
+		provisioners, moreDiags := loadConfigProvisioners(listVal.Filter("provisioner"), connInfo)
+		for _, diag := range moreDiags {
+			diag.Message = fmt.Sprintf("resource %s.%s: %s", t, n, diag.Message)
+		}
+		diags = append(diags, moreDiags...)
+
+		var lifecycle tfcfg.ResourceLifecycle
+		diags = append(diags, loadConfigResourceLifecycle(listVal, &lifecycle, t, n)...)
+
+		positions.record(targetDeclKey(targetName, "resource "+t+"."+n), configItemPos(item))
+		result = append(result, &tfcfg.Resource{
+			Mode:         tfcfg.ManagedResourceMode,
+			Name:         n,
+			Type:         t,
+			RawCount:     countConfig,
+			RawConfig:    rawConfig,
+			Provider:     provider,
+			Provisioners: provisioners,
+			DependsOn:    dependsOn,
+			Lifecycle:    lifecycle,
+		})
+	}
+
+	return result, diags
+}
+
+func loadConfigProvisioners(hclConfig *ast.ObjectList, connInfo map[string]interface{}) ([]*tfcfg.Provisioner, Diagnostics) {
+	result := make([]*tfcfg.Provisioner, 0, len(hclConfig.Items))
+	var diags Diagnostics
+
+	for _, item := range expandJSONBlockItems(hclConfig, 1).Items {
+		labels, listVal, blockDiags := configBlock(item, "provisioner", 1, "a type")
+		if len(blockDiags) > 0 {
+			diags = append(diags, blockDiags...)
+			continue
+		}
+		n := labels[0]
+
+		_, rawConfig, bodyDiags := decodeConfigBody(
+			item, fmt.Sprintf("provisioner config %s", n), "connection",
+		)
+		if len(bodyDiags) > 0 {
+			diags = append(diags, bodyDiags...)
+			continue
+		}
+
+		// A provisioner-level connection block inherits any settings
+		// it doesn't override from the resource-level block.
+		var subConnInfo map[string]interface{}
+		connDiags := decodeConfigAttr(
+			listVal, "connection", &subConnInfo,
+			fmt.Sprintf("provisioner %s connection", n),
+		)
+		if len(connDiags) > 0 {
+			diags = append(diags, connDiags...)
+			continue
+		}
+		if subConnInfo == nil {
+			subConnInfo = connInfo
+		} else {
+			for k, v := range connInfo {
+				if _, exists := subConnInfo[k]; !exists {
+					subConnInfo[k] = v
+				}
+			}
+		}
+
+		connRaw, err := tfcfg.NewRawConfig(subConnInfo)
 		if err != nil {
-			return nil, fmt.Errorf(
-				"error reading output config %s: %s", n, err,
-			)
+			diags = append(diags, diagErrorf(
+				configItemPos(item), "error reading provisioner %s connection: %s", n, err,
+			))
+			continue
 		}
 
-		result = append(result, &tfcfg.Output{
-			Name:      n,
+		result = append(result, &tfcfg.Provisioner{
+			Type:      n,
 			RawConfig: rawConfig,
+			ConnInfo:  connRaw,
 		})
 	}
 
-	return result, nil
+	return result, diags
+}
+
+func loadConfigResourceCount(listVal *ast.ObjectList, t, n string) (*tfcfg.RawConfig, Diagnostics) {
+	count := "1"
+	diags := decodeConfigAttr(
+		listVal, "count", &count,
+		fmt.Sprintf("%s.%s count", t, n),
+	)
+
+	countConfig, err := tfcfg.NewRawConfig(map[string]interface{}{
+		"count": count,
+	})
+	if err != nil {
+		// count can only be invalid if it was set explicitly
+		item := listVal.Filter("count").Items[0]
+		diags = append(diags, diagErrorf(
+			item.Val.Pos(), "error reading %s.%s count: %s", t, n, err,
+		))
+		return nil, diags
+	}
+	countConfig.Key = "count"
+
+	return countConfig, diags
+}
+
+func loadConfigResourceLifecycle(listVal *ast.ObjectList, lifecycle *tfcfg.ResourceLifecycle, t, n string) Diagnostics {
+	a := listVal.Filter("lifecycle")
+	if len(a.Items) == 0 {
+		return nil
+	}
+	item := a.Items[0]
+
+	var raw map[string]interface{}
+	err := hcl.DecodeObject(&raw, item.Val)
+	if err != nil {
+		return Diagnostics{
+			diagErrorf(configItemPos(item), "error reading resource %s.%s lifecycle: %s", t, n, err),
+		}
+	}
+
+	var diags Diagnostics
+	for k := range raw {
+		switch k {
+		case "create_before_destroy", "ignore_changes", "prevent_destroy":
+		default:
+			diags = append(diags, diagErrorf(
+				configItemPos(item), "error reading resource %s.%s lifecycle: invalid key %s", t, n, k,
+			))
+		}
+	}
+	if len(diags) > 0 {
+		return diags
+	}
+
+	err = mapstructure.WeakDecode(raw, lifecycle)
+	if err != nil {
+		return Diagnostics{
+			diagErrorf(configItemPos(item), "error reading resource %s.%s lifecycle: %s", t, n, err),
+		}
+	}
+
+	return nil
+}
+
+// expandJSONBlockItems undoes the nesting of blocks written in JSON as
+// lists, as in {"provider": {"aws": [{...}, {...}]}}, which is how several
+// blocks of the same type and name are written in JSON.
+//
+// The HCL parser only flattens nested JSON objects into an item's keys
+// when all of their properties are objects, so a list of blocks leaves
+// the labels of the blocks around it inside the item's value rather than
+// in its keys. Given the number of labels each block should have, this
+// replaces any such item with a separate item for each block inside it.
+func expandJSONBlockItems(hclConfig *ast.ObjectList, numLabels int) *ast.ObjectList {
+	result := &ast.ObjectList{}
+
+	for _, item := range hclConfig.Items {
+		ot, ok := item.Val.(*ast.ObjectType)
+		if len(item.Keys) >= numLabels || !ok || !jsonObjectItems(ot.List) {
+			result.Add(item)
+			continue
+		}
+
+		for _, child := range ot.List.Items {
+			keys := make([]*ast.ObjectKey, 0, len(item.Keys)+len(child.Keys))
+			keys = append(keys, item.Keys...)
+			keys = append(keys, child.Keys...)
+			expanded := expandJSONBlockItems(&ast.ObjectList{
+				Items: []*ast.ObjectItem{
+					{
+						Keys: keys,
+						Val:  child.Val,
+					},
+				},
+			}, numLabels)
+			result.Items = append(result.Items, expanded.Items...)
+		}
+	}
+
+	return result
+}
+
+// jsonObjectItems returns true if the given list has items and they all
+// came from the properties of a JSON object.
+func jsonObjectItems(list *ast.ObjectList) bool {
+	if len(list.Items) == 0 {
+		return false
+	}
+	for _, item := range list.Items {
+		if len(item.Keys) == 0 || !item.Keys[0].Token.JSON {
+			return false
+		}
+	}
+	return true
+}
+
+// unwrapJSONObjectKeys undoes the flattening that the HCL parser applies to
+// nested JSON objects, so that JSON configuration has the same structure as
+// the equivalent native HCL configuration.
+//
+// When parsing JSON, an object whose properties are all themselves objects
+// is flattened into its parent, so e.g. {"ami": {"output": {"id": {...}}}}
+// appears as a single item with the keys "ami", "output" and "id". Given
+// the number of keys the item should have, this moves any extra keys back
+// into nested objects.
+func unwrapJSONObjectKeys(item *ast.ObjectItem, depth int) {
+	if len(item.Keys) <= depth || !item.Keys[0].Token.JSON {
+		return
+	}
+
+	for len(item.Keys) > depth {
+		n := len(item.Keys)
+		key := item.Keys[n-1]
+		item.Keys = item.Keys[:n-1]
+
+		item.Val = &ast.ObjectType{
+			List: &ast.ObjectList{
+				Items: []*ast.ObjectItem{
+					{
+						Keys: []*ast.ObjectKey{key},
+						Val:  item.Val,
+					},
+				},
+			},
+		}
+	}
 }
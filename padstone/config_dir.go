@@ -0,0 +1,284 @@
+package padstone
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	tfcfg "github.com/hashicorp/terraform/config"
+)
+
+// configFileExts are the filename extensions of the files that are loaded
+// from a configuration directory. Longer extensions must appear before any
+// shorter extensions that are their suffixes.
+var configFileExts = []string{".padstone.json", ".padstone", ".hcl"}
+
+// LoadConfigDir loads all of the configuration files in the given directory
+// and combines them into a single configuration.
+//
+// Files with the extensions .padstone and .hcl are expected to be in the
+// native HCL syntax, while files with the extension .padstone.json are
+// expected to be in the equivalent JSON syntax. Other files are ignored,
+// so that the directory may also contain other tools' files, such as
+// Terraform configuration or package manifests.
+//
+// The ordinary files are loaded first, in lexical order, and each variable,
+// provider, target and default target list may be defined in only one of
+// them. Then any override files, whose names are "override" or end with
+// "_override", are loaded in lexical order and merged into the result,
+// replacing or extending what was defined in the ordinary files.
+func LoadConfigDir(dir string) (*Config, error) {
+	files, overrides, err := configDirFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no configuration files found in directory %s", dir)
+	}
+
+	result := &Config{
+		SourceDir: dir,
+		positions: make(configPositions),
+	}
+	definedIn := make(map[string]string)
+
+	var diags Diagnostics
+
+	for _, filename := range files {
+		config, moreDiags := loadConfigDirFile(filename)
+		diags = append(diags, moreDiags...)
+		if config == nil {
+			continue
+		}
+
+		diags = append(diags, appendConfig(result, config, definedIn)...)
+		result.positions.add(config.positions)
+	}
+
+	for _, filename := range overrides {
+		config, moreDiags := loadConfigDirFile(filename)
+		diags = append(diags, moreDiags...)
+		if config == nil {
+			continue
+		}
+
+		err = mergeConfig(result, config)
+		if err != nil {
+			diags = append(diags, &Diagnostic{
+				Severity: DiagnosticError,
+				Message:  fmt.Sprintf("error applying overrides: %s", err),
+				Filename: filename,
+			})
+		}
+		result.positions.add(config.positions)
+	}
+
+	if diags.HasErrors() {
+		return nil, diags.Err()
+	}
+
+	diags = result.checkDefaultTargets()
+	if diags.HasErrors() {
+		return nil, diags.Err()
+	}
+
+	return result, nil
+}
+
+// loadConfigDirFile loads a single file from a configuration directory.
+// The returned configuration is nil if the file could not be read or
+// parsed at all.
+func loadConfigDirFile(filename string) (*Config, Diagnostics) {
+	configBytes, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, Diagnostics{
+			&Diagnostic{
+				Severity: DiagnosticError,
+				Message:  err.Error(),
+				Filename: filename,
+			},
+		}
+	}
+
+	return parseConfig(configBytes, filename)
+}
+
+// configDirFiles returns the paths of the ordinary configuration files and
+// the override files in the given directory, each in lexical order.
+func configDirFiles(dir string) ([]string, []string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files, overrides []string
+
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+
+		name := info.Name()
+
+		// Skip hidden files and the temporary files of common editors.
+		if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "#") || strings.HasSuffix(name, "~") {
+			continue
+		}
+
+		var base string
+		for _, ext := range configFileExts {
+			if strings.HasSuffix(name, ext) {
+				base = strings.TrimSuffix(name, ext)
+				break
+			}
+		}
+		if base == "" {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		if base == "override" || strings.HasSuffix(base, "_override") {
+			overrides = append(overrides, path)
+		} else {
+			files = append(files, path)
+		}
+	}
+
+	sort.Strings(files)
+	sort.Strings(overrides)
+
+	return files, overrides, nil
+}
+
+// appendConfig adds the definitions from the given configuration to the
+// result configuration, returning an error diagnostic for each thing that
+// is defined in both.
+//
+// definedIn records the file that each definition came from, so that the
+// diagnostics can name both files.
+func appendConfig(result *Config, config *Config, definedIn map[string]string) Diagnostics {
+	var diags Diagnostics
+
+	define := func(what string) bool {
+		if prev, exists := definedIn[what]; exists {
+			diag := diagErrorf(
+				config.declPos(what, 0),
+				"%s is defined in both %s and %s", what, prev, config.SourceFilename,
+			)
+			diag.Filename = config.SourceFilename
+			diags = append(diags, diag)
+			return false
+		}
+		definedIn[what] = config.SourceFilename
+		return true
+	}
+
+	for _, variable := range config.Variables {
+		if define("variable " + variable.Name) {
+			result.Variables = append(result.Variables, variable)
+		}
+	}
+
+	for _, provider := range config.Providers {
+		if define("provider " + provider.FullName()) {
+			result.Providers = append(result.Providers, provider)
+		}
+	}
+
+	for _, target := range config.Targets {
+		if define("target " + target.Name) {
+			result.Targets = append(result.Targets, target)
+		}
+	}
+
+	if len(config.DefaultBuildTargets) > 0 {
+		if define("default_build_targets") {
+			result.DefaultBuildTargets = config.DefaultBuildTargets
+		}
+	}
+
+	if len(config.DefaultDevTargets) > 0 {
+		if define("default_dev_targets") {
+			result.DefaultDevTargets = config.DefaultDevTargets
+		}
+	}
+
+	if config.BuildTTL != 0 {
+		if define("build_ttl") {
+			result.BuildTTL = config.BuildTTL
+		}
+	}
+
+	return diags
+}
+
+// mergeConfig merges the definitions from the given override configuration
+// into the result configuration, using the same rules as Terraform uses for
+// its own override files.
+func mergeConfig(result *Config, override *Config) error {
+	merged, err := tfcfg.Merge(
+		&tfcfg.Config{
+			Variables:       result.Variables,
+			ProviderConfigs: result.Providers,
+		},
+		&tfcfg.Config{
+			Variables:       override.Variables,
+			ProviderConfigs: override.Providers,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	result.Variables = merged.Variables
+	result.Providers = merged.ProviderConfigs
+
+	for _, overrideTarget := range override.Targets {
+		target := result.Target(overrideTarget.Name)
+		if target == nil {
+			result.Targets = append(result.Targets, overrideTarget)
+			continue
+		}
+
+		merged, err := tfcfg.Merge(
+			&tfcfg.Config{
+				Modules:         target.Modules,
+				ProviderConfigs: target.Providers,
+				Resources:       target.Resources,
+				Outputs:         target.Outputs,
+			},
+			&tfcfg.Config{
+				Modules:         overrideTarget.Modules,
+				ProviderConfigs: overrideTarget.Providers,
+				Resources:       overrideTarget.Resources,
+				Outputs:         overrideTarget.Outputs,
+			},
+		)
+		if err != nil {
+			return fmt.Errorf("target %s: %s", target.Name, err)
+		}
+
+		target.Modules = merged.Modules
+		target.Providers = merged.ProviderConfigs
+		target.Resources = merged.Resources
+		target.Outputs = merged.Outputs
+	}
+
+	// The default target lists are replaced rather than merged, so their
+	// positions are forgotten here and then taken from the override when
+	// its positions are added.
+	if len(override.DefaultBuildTargets) > 0 {
+		result.DefaultBuildTargets = override.DefaultBuildTargets
+		delete(result.positions, "default_build_targets")
+	}
+	if len(override.DefaultDevTargets) > 0 {
+		result.DefaultDevTargets = override.DefaultDevTargets
+		delete(result.positions, "default_dev_targets")
+	}
+	if override.BuildTTL != 0 {
+		result.BuildTTL = override.BuildTTL
+	}
+
+	return nil
+}
@@ -0,0 +1,68 @@
+package padstone
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigDir(t *testing.T) {
+	config, err := LoadConfig(filepath.Join("test-fixtures", "dir-basic"))
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %s", err)
+	}
+
+	if got, want := config.SourceDir, filepath.Join("test-fixtures", "dir-basic"); got != want {
+		t.Fatalf("got source dir %q; want %q", got, want)
+	}
+
+	if got, want := len(config.Variables), 1; got != want {
+		t.Fatalf("got %d variables; want %d", got, want)
+	}
+	if got, want := config.Variables[0].Default, "1.0.0"; got != want {
+		t.Fatalf("got version default %#v; want %#v", got, want)
+	}
+
+	if got, want := len(config.Providers), 2; got != want {
+		t.Fatalf("got %d providers; want %d", got, want)
+	}
+	if got, want := providerNames(config.Providers), []string{"aws", "aws.use1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got providers %#v; want %#v", got, want)
+	}
+
+	if got, want := config.DefaultBuildTargets, []string{"ami"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got default build targets %#v; want %#v", got, want)
+	}
+
+	if got, want := len(config.Targets), 2; got != want {
+		t.Fatalf("got %d targets; want %d", got, want)
+	}
+
+	target := config.Target("ami_source_instance")
+	if target == nil {
+		t.Fatalf("no target named ami_source_instance")
+	}
+	if got, want := len(target.Resources), 1; got != want {
+		t.Fatalf("ami_source_instance has %d resources; want %d", got, want)
+	}
+	raw := target.Resources[0].RawConfig.Raw
+	if got, want := raw["instance_type"], "t2.micro"; got != want {
+		t.Fatalf("got instance_type %#v; want %#v", got, want)
+	}
+	if got, want := raw["ami"], "ami-06b94666"; got != want {
+		t.Fatalf("got ami %#v; want %#v", got, want)
+	}
+}
+
+func TestLoadConfigDirDuplicate(t *testing.T) {
+	dir := filepath.Join("test-fixtures", "dir-duplicate")
+	_, err := LoadConfig(dir)
+	if err == nil {
+		t.Fatalf("succeeded; want error")
+	}
+
+	want := filepath.Join(dir, "b.padstone") + ":1:8: target ami is defined in both " + filepath.Join(dir, "a.padstone") + " and " + filepath.Join(dir, "b.padstone")
+	if got := err.Error(); got != want {
+		t.Fatalf("got error %q; want %q", got, want)
+	}
+}
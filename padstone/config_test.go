@@ -2,7 +2,9 @@ package padstone
 
 import (
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	tfcfg "github.com/hashicorp/terraform/config"
 )
@@ -50,6 +52,16 @@ func TestConfigParsing(t *testing.T) {
 		}
 	}
 
+	// Default target lists
+	{
+		if got, want := config.DefaultBuildTargets, []string{"ami"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got default build targets %#v; want %#v", got, want)
+		}
+		if got, want := config.DefaultDevTargets, []string{"dev"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got default dev targets %#v; want %#v", got, want)
+		}
+	}
+
 	// Target blocks
 	{
 		if got, want := len(config.Targets), 3; got != want {
@@ -88,6 +100,28 @@ func TestConfigParsing(t *testing.T) {
 			if got, want := target.Outputs[0].RawConfig.Raw["value"], "${aws_ami_from_instance.result.id}"; got != want {
 				t.Fatalf("target 0 output 0 value %q; want %q", got, want)
 			}
+
+			if got, want := len(target.Resources), 2; got != want {
+				t.Fatalf("target 0 has %d resources; want %d", got, want)
+			}
+			if got, want := target.Resources[0].Id(), "aws_ami_from_instance.result"; got != want {
+				t.Fatalf("target 0 resource 0 is %q; want %q", got, want)
+			}
+			if got, want := target.Resources[0].RawConfig.Raw["instance_id"], "${target.ami_source_instance.id}"; got != want {
+				t.Fatalf("target 0 resource 0 instance_id %q; want %q", got, want)
+			}
+			if got, want := target.Resources[1].Id(), "aws_ami_copy.result"; got != want {
+				t.Fatalf("target 0 resource 1 is %q; want %q", got, want)
+			}
+			if got, want := target.Resources[1].Provider, "aws.usw2"; got != want {
+				t.Fatalf("target 0 resource 1 provider %q; want %q", got, want)
+			}
+			if _, exists := target.Resources[1].RawConfig.Raw["provider"]; exists {
+				t.Fatalf("target 0 resource 1 has 'provider' in its config; should've been removed")
+			}
+			if got, want := target.Resources[1].RawCount.Raw["count"], "1"; got != want {
+				t.Fatalf("target 0 resource 1 count %q; want %q", got, want)
+			}
 		}
 
 		{
@@ -109,10 +143,382 @@ func TestConfigParsing(t *testing.T) {
 			if got, want := target.Modules[0].RawConfig.Raw["vpc_id"], "vpc-12345"; got != want {
 				t.Fatalf("target 1 module vpc_id %q; want %q", got, want)
 			}
+
+			if got, want := len(target.Resources), 2; got != want {
+				t.Fatalf("target 1 has %d resources; want %d", got, want)
+			}
+			if got, want := target.Resources[0].Id(), "data.aws_ami.ubuntu"; got != want {
+				t.Fatalf("target 1 resource 0 is %q; want %q", got, want)
+			}
+			if got, want := target.Resources[0].Mode, tfcfg.DataResourceMode; got != want {
+				t.Fatalf("target 1 resource 0 has mode %s; want %s", got, want)
+			}
+			if got, want := target.Resources[1].Id(), "aws_instance.result"; got != want {
+				t.Fatalf("target 1 resource 1 is %q; want %q", got, want)
+			}
+			if got, want := target.Resources[1].Mode, tfcfg.ManagedResourceMode; got != want {
+				t.Fatalf("target 1 resource 1 has mode %s; want %s", got, want)
+			}
+		}
+
+		{
+			target := config.Targets[2]
+
+			if got, want := len(target.Resources), 2; got != want {
+				t.Fatalf("target 2 has %d resources; want %d", got, want)
+			}
+			if got, want := target.Resources[0].Id(), "data.docker_image.ubuntu"; got != want {
+				t.Fatalf("target 2 resource 0 is %q; want %q", got, want)
+			}
+			if got, want := target.Resources[1].Id(), "docker_container.app"; got != want {
+				t.Fatalf("target 2 resource 1 is %q; want %q", got, want)
+			}
 		}
 	}
 }
 
+func TestConfigParsingUndeclaredDefaultTarget(t *testing.T) {
+	_, err := ParseConfig([]byte(`
+default_build_targets = ["nonexist"]
+
+target "ami" {
+}
+`), "padstone.hcl")
+	if err == nil {
+		t.Fatalf("succeeded; want error")
+	}
+	if got, want := err.Error(), "padstone.hcl:2:25: default_build_targets refers to undeclared target nonexist"; got != want {
+		t.Fatalf("got error %q; want %q", got, want)
+	}
+}
+
+func TestConfigParsingRepeatedAttr(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+variable "version" {
+  default = "dev"
+  default = "1.0.0"
+}
+`), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The last of the settings wins.
+	if got, want := config.Variables[0].Default, "1.0.0"; got != want {
+		t.Fatalf("got default %#v; want %#v", got, want)
+	}
+}
+
+func TestConfigParsingBuildTTL(t *testing.T) {
+	inputs := map[string]string{
+		"padstone.hcl":  `build_ttl = "72h"`,
+		"padstone.json": `{"build_ttl": "72h"}`,
+	}
+
+	for filename, input := range inputs {
+		config, err := ParseConfig([]byte(input), filename)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", filename, err)
+		}
+		if got, want := config.BuildTTL, 72*time.Hour; got != want {
+			t.Fatalf("%s: got build TTL %s; want %s", filename, got, want)
+		}
+	}
+}
+
+func TestConfigParsingDiagnostics(t *testing.T) {
+	_, err := ParseConfig([]byte(`
+target {
+}
+
+target "ami" {
+  resource "aws_instance" {
+  }
+
+  output = "foo"
+}
+
+default_build_targets = "ami"
+build_ttl = "soon"
+`), "padstone.hcl")
+	if err == nil {
+		t.Fatalf("succeeded; want error")
+	}
+
+	diags, ok := err.(Diagnostics)
+	if !ok {
+		t.Fatalf("got error of type %T; want Diagnostics", err)
+	}
+
+	want := []string{
+		"padstone.hcl:2:8: target block must have a name",
+		"padstone.hcl:6:12: resource block must have a type and a name",
+		"padstone.hcl:9:12: output block must have a name",
+		"padstone.hcl:12:25: error reading default_build_targets: ",
+		"padstone.hcl:13:13: build_ttl must be a duration, such as \"72h\"",
+	}
+	if got, want := len(diags), len(want); got != want {
+		t.Fatalf("got %d diagnostics; want %d\n%s", got, want, diags)
+	}
+	for i, diag := range diags {
+		if got, want := diag.Error(), want[i]; !strings.HasPrefix(got, want) {
+			t.Errorf("diagnostic %d is %q; want %q", i, got, want)
+		}
+	}
+}
+
+func TestConfigParsingSyntaxError(t *testing.T) {
+	_, err := ParseConfig([]byte(`
+target "ami" {
+  output "id" {
+    value = = "foo"
+  }
+}
+`), "padstone.hcl")
+	if err == nil {
+		t.Fatalf("succeeded; want error")
+	}
+
+	diags, ok := err.(Diagnostics)
+	if !ok {
+		t.Fatalf("got error of type %T; want Diagnostics", err)
+	}
+	if got, want := len(diags), 1; got != want {
+		t.Fatalf("got %d diagnostics; want %d\n%s", got, want, diags)
+	}
+	if got, want := diags[0].Filename, "padstone.hcl"; got != want {
+		t.Errorf("got filename %q; want %q", got, want)
+	}
+	if got, want := diags[0].Line, 4; got != want {
+		t.Errorf("got line %d; want %d", got, want)
+	}
+}
+
+func TestConfigParsingMalformed(t *testing.T) {
+	// None of these are valid, but they must all produce errors rather
+	// than panics.
+	inputs := []string{
+		`target`,
+		`target = "ami"`,
+		`target "ami" "extra" {}`,
+		`target "ami" { resource = 1 }`,
+		`target "ami" { resource "a" "b" "c" {} }`,
+		`target "ami" { data "a" {} }`,
+		`target "ami" { module {} }`,
+		`target "ami" { resource "a" "b" { provisioner = "x" } }`,
+		`target "ami" { resource "a" "b" { lifecycle { bogus = true } } }`,
+		`variable { default = "x" }`,
+		`provider = {}`,
+		`default_dev_targets "x" {}`,
+		`{"target": "ami"}`,
+		`{"target": {"ami": {"resource": "x"}}}`,
+		`{"target": {"ami": {"output": {"id": "x"}}}}`,
+		`{"variable": ["x"]}`,
+		`{"default_build_targets": {"a": {}}}`,
+	}
+
+	for _, input := range inputs {
+		_, err := ParseConfig([]byte(input), "padstone.hcl")
+		if err == nil {
+			t.Errorf("parsing %s succeeded; want error", input)
+		}
+	}
+}
+
+func TestConfigParsingJSON(t *testing.T) {
+	hclConfig, err := ParseConfig([]byte(configTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing HCL config: %s", err)
+	}
+	config, err := ParseConfig([]byte(configTestConfigJSON), "padstone.json")
+	if err != nil {
+		t.Fatalf("unexpected error parsing JSON config: %s", err)
+	}
+
+	// Variable blocks
+	{
+		if !reflect.DeepEqual(config.Variables, hclConfig.Variables) {
+			t.Fatalf("got variables %#v; want %#v", config.Variables, hclConfig.Variables)
+		}
+	}
+
+	// Provider blocks
+	{
+		if got, want := providerSummaries(config.Providers), providerSummaries(hclConfig.Providers); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got providers %#v; want %#v", got, want)
+		}
+	}
+
+	// Default target lists
+	{
+		if got, want := config.DefaultBuildTargets, hclConfig.DefaultBuildTargets; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got default build targets %#v; want %#v", got, want)
+		}
+		if got, want := config.DefaultDevTargets, hclConfig.DefaultDevTargets; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got default dev targets %#v; want %#v", got, want)
+		}
+	}
+
+	// Target blocks
+	{
+		if got, want := len(config.Targets), len(hclConfig.Targets); got != want {
+			t.Fatalf("got %d targets; want %d", got, want)
+		}
+
+		for i, target := range config.Targets {
+			hclTarget := hclConfig.Targets[i]
+
+			if got, want := target.Name, hclTarget.Name; got != want {
+				t.Fatalf("target %d named %q; want %q", i, got, want)
+			}
+			if got, want := providerSummaries(target.Providers), providerSummaries(hclTarget.Providers); !reflect.DeepEqual(got, want) {
+				t.Fatalf("target %d got providers %#v; want %#v", i, got, want)
+			}
+
+			if got, want := len(target.Modules), len(hclTarget.Modules); got != want {
+				t.Fatalf("target %d has %d modules; want %d", i, got, want)
+			}
+			for j, module := range target.Modules {
+				hclModule := hclTarget.Modules[j]
+				if got, want := module.Name, hclModule.Name; got != want {
+					t.Fatalf("target %d module %d named %q; want %q", i, j, got, want)
+				}
+				if got, want := module.Source, hclModule.Source; got != want {
+					t.Fatalf("target %d module %d source %q; want %q", i, j, got, want)
+				}
+				if got, want := module.RawConfig.Raw, hclModule.RawConfig.Raw; !reflect.DeepEqual(got, want) {
+					t.Fatalf("target %d module %d config %#v; want %#v", i, j, got, want)
+				}
+			}
+
+			if got, want := len(target.Resources), len(hclTarget.Resources); got != want {
+				t.Fatalf("target %d has %d resources; want %d", i, got, want)
+			}
+			for j, resource := range target.Resources {
+				hclResource := hclTarget.Resources[j]
+				if got, want := resource.Id(), hclResource.Id(); got != want {
+					t.Fatalf("target %d resource %d is %q; want %q", i, j, got, want)
+				}
+				if got, want := resource.Provider, hclResource.Provider; got != want {
+					t.Fatalf("target %d resource %d provider %q; want %q", i, j, got, want)
+				}
+				if got, want := resource.RawConfig.Raw, hclResource.RawConfig.Raw; !reflect.DeepEqual(got, want) {
+					t.Fatalf("target %d resource %d config %#v; want %#v", i, j, got, want)
+				}
+				if got, want := resource.RawCount.Raw, hclResource.RawCount.Raw; !reflect.DeepEqual(got, want) {
+					t.Fatalf("target %d resource %d count %#v; want %#v", i, j, got, want)
+				}
+			}
+
+			if got, want := len(target.Outputs), len(hclTarget.Outputs); got != want {
+				t.Fatalf("target %d has %d outputs; want %d", i, got, want)
+			}
+			for j, output := range target.Outputs {
+				hclOutput := hclTarget.Outputs[j]
+				if got, want := output.Name, hclOutput.Name; got != want {
+					t.Fatalf("target %d output %d named %q; want %q", i, j, got, want)
+				}
+				if got, want := output.RawConfig.Raw, hclOutput.RawConfig.Raw; !reflect.DeepEqual(got, want) {
+					t.Fatalf("target %d output %d config %#v; want %#v", i, j, got, want)
+				}
+			}
+		}
+	}
+
+	// Repeated blocks written as lists
+	{
+		hclConfig, err := ParseConfig([]byte(`
+provider "aws" {
+  region = "us-west-2"
+}
+provider "aws" {
+  region = "us-east-1"
+  alias = "use1"
+}
+target "a" {
+  provider "aws" {
+    region = "us-west-2"
+  }
+  provider "aws" {
+    region = "us-east-1"
+    alias = "use1"
+  }
+  output "x" {
+    value = "x"
+  }
+}
+target "b" {
+  output "y" {
+    value = "${target.a.x}"
+  }
+}
+`), "lists.hcl")
+		if err != nil {
+			t.Fatalf("unexpected error parsing HCL config: %s", err)
+		}
+		config, err := ParseConfig([]byte(`
+{
+  "provider": {
+    "aws": [
+      {"region": "us-west-2"},
+      {"region": "us-east-1", "alias": "use1"}
+    ]
+  },
+  "target": {
+    "a": [
+      {
+        "provider": {
+          "aws": [
+            {"region": "us-west-2"},
+            {"region": "us-east-1", "alias": "use1"}
+          ]
+        }
+      },
+      {
+        "output": {"x": {"value": "x"}}
+      }
+    ],
+    "b": {
+      "output": {"y": {"value": "${target.a.x}"}}
+    }
+  }
+}
+`), "lists.json")
+		if err != nil {
+			t.Fatalf("unexpected error parsing JSON config: %s", err)
+		}
+
+		if got, want := providerSummaries(config.Providers), providerSummaries(hclConfig.Providers); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got providers %#v; want %#v", got, want)
+		}
+		if got, want := len(config.Targets), len(hclConfig.Targets); got != want {
+			t.Fatalf("got %d targets; want %d", got, want)
+		}
+		for i, target := range config.Targets {
+			hclTarget := hclConfig.Targets[i]
+			if got, want := target.Name, hclTarget.Name; got != want {
+				t.Fatalf("target %d named %q; want %q", i, got, want)
+			}
+			if got, want := providerSummaries(target.Providers), providerSummaries(hclTarget.Providers); !reflect.DeepEqual(got, want) {
+				t.Fatalf("target %d got providers %#v; want %#v", i, got, want)
+			}
+			if got, want := len(target.Outputs), len(hclTarget.Outputs); got != want {
+				t.Fatalf("target %d has %d outputs; want %d", i, got, want)
+			}
+		}
+	}
+}
+
+// providerSummaries returns the full name and raw configuration of each of
+// the given providers, for comparison in tests.
+func providerSummaries(providers []*tfcfg.ProviderConfig) map[string]map[string]interface{} {
+	ret := make(map[string]map[string]interface{}, len(providers))
+	for _, provider := range providers {
+		ret[provider.FullName()] = provider.RawConfig.Raw
+	}
+	return ret
+}
+
 const configTestConfig = `
 variable "version" {
   default     = "dev"
@@ -185,3 +591,113 @@ target "dev" {
   }
 }
 `
+
+// configTestConfigJSON is the JSON equivalent of configTestConfig.
+const configTestConfigJSON = `
+{
+  "variable": {
+    "version": {
+      "default": "dev",
+      "description": "version number"
+    }
+  },
+
+  "provider": {
+    "aws": {
+      "region": "us-west-2"
+    }
+  },
+
+  "default_build_targets": ["ami"],
+  "default_dev_targets": ["dev"],
+
+  "target": {
+    "ami": {
+      "provider": {
+        "aws": {
+          "region": "us-east-1",
+          "alias": "use1"
+        }
+      },
+
+      "resource": {
+        "aws_ami_from_instance": {
+          "result": {
+            "instance_id": "${target.ami_source_instance.id}"
+          }
+        },
+        "aws_ami_copy": {
+          "result": {
+            "source_ami_id": "${aws_ami_from_instance.result.id}",
+            "source_region": "us-east-1",
+
+            "provider": "aws.usw2"
+          }
+        }
+      },
+
+      "output": {
+        "usw2_id": {
+          "value": "${aws_ami_from_instance.result.id}"
+        },
+        "use1_id": {
+          "value": "${aws_ami_copy.result.id}"
+        }
+      }
+    },
+
+    "ami_source_instance": {
+      "module": {
+        "build_support": {
+          "source": "./build_support",
+          "vpc_id": "vpc-12345"
+        }
+      },
+
+      "data": {
+        "aws_ami": {
+          "ubuntu": {
+            "id": "ami-06b94666"
+          }
+        }
+      },
+
+      "resource": {
+        "aws_instance": {
+          "result": {
+            "ami": "${data.aws_ami.ubuntu.id}",
+            "instance_type": "m3.medium",
+            "subnet_id": "${module.build_support.subnet_id}",
+            "vpc_security_group_id": ["${module.build_support.security_group_id}"]
+          }
+        }
+      },
+
+      "output": {
+        "id": {
+          "value": "${aws_instance.result.id}"
+        }
+      }
+    },
+
+    "dev": {
+      "data": {
+        "docker_image": {
+          "ubuntu": {
+            "name": "ubuntu:xenial"
+          }
+        }
+      },
+
+      "resource": {
+        "docker_container": {
+          "app": {
+            "name": "myapp-dev",
+            "image": "${data.docker_image.ubuntu.latest}"
+          }
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,264 @@
+package padstone
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/hcl/token"
+	tfcfg "github.com/hashicorp/terraform/config"
+)
+
+// Validate checks the configuration for mistakes that can be found without
+// loading any modules or talking to any providers, such as duplicate names
+// and references to things that are not declared.
+//
+// All of the problems found are returned together, so that they can be
+// fixed in a single pass.
+func (c *Config) Validate() Diagnostics {
+	v := &configValidator{
+		config: c,
+	}
+
+	v.checkUnique("", "variable", variableNames(c.Variables))
+	v.checkUnique("", "provider", providerNames(c.Providers))
+
+	targetNames := make([]string, len(c.Targets))
+	for i, target := range c.Targets {
+		targetNames[i] = target.Name
+	}
+	v.checkUnique("", "target", targetNames)
+
+	for _, provider := range c.Providers {
+		v.checkRefs(nil, "provider "+provider.FullName(), provider.RawConfig)
+	}
+
+	for _, target := range c.Targets {
+		v.validateTarget(target)
+	}
+
+	v.diags = append(v.diags, c.checkDefaultTargets()...)
+
+	// Cycles are only worth looking for once all of the references are
+	// known to be valid, since an undeclared target is reported above.
+	if !v.diags.HasErrors() {
+		if _, err := c.TargetGraph(); err != nil {
+			v.errorf("", "", "%s", err)
+		}
+	}
+
+	return v.diags
+}
+
+// configValidator accumulates the diagnostics for Config.Validate.
+type configValidator struct {
+	config *Config
+	diags  Diagnostics
+}
+
+// errorf records an error diagnostic about the target with the given name,
+// or about the configuration as a whole if targetName is empty. The
+// diagnostic is placed at the declaration described by what within that
+// target, such as "output id", if its position is known.
+func (v *configValidator) errorf(targetName string, what string, format string, args ...interface{}) {
+	v.errorAt(targetName, what, 0, format, args...)
+}
+
+// errorAt is like errorf, but places the diagnostic at the nth declaration
+// of what, for problems caused by declaring something more than once.
+func (v *configValidator) errorAt(targetName string, what string, n int, format string, args ...interface{}) {
+	var pos token.Pos
+	if what != "" {
+		pos = v.config.declPos(targetDeclKey(targetName, what), n)
+	}
+
+	diag := diagErrorf(pos, format, args...)
+	if diag.Filename == "" {
+		diag.Filename = v.config.SourceFilename
+	}
+	diag.Target = targetName
+	v.diags = append(v.diags, diag)
+}
+
+// checkUnique reports each name that appears more than once in the given
+// list, once per name, at its second declaration.
+func (v *configValidator) checkUnique(targetName string, what string, names []string) {
+	counts := make(map[string]int, len(names))
+	for _, name := range names {
+		counts[name]++
+		if counts[name] == 2 {
+			v.errorAt(targetName, what+" "+name, 1, "%s %s is declared more than once", what, name)
+		}
+	}
+}
+
+func (v *configValidator) validateTarget(target *TargetConfig) {
+	moduleNames := make([]string, len(target.Modules))
+	for i, module := range target.Modules {
+		moduleNames[i] = module.Name
+	}
+	resourceIDs := make([]string, len(target.Resources))
+	for i, resource := range target.Resources {
+		resourceIDs[i] = resource.Id()
+	}
+	outputNames := make([]string, len(target.Outputs))
+	for i, output := range target.Outputs {
+		outputNames[i] = output.Name
+	}
+
+	v.checkUnique(target.Name, "provider", providerNames(target.Providers))
+	v.checkUnique(target.Name, "module", moduleNames)
+	v.checkUnique(target.Name, "resource", resourceIDs)
+	v.checkUnique(target.Name, "output", outputNames)
+
+	// A resource may use any provider declared either globally or within
+	// its own target.
+	providers := make(map[string]bool)
+	for _, name := range providerNames(v.config.Providers) {
+		providers[name] = true
+	}
+	for _, name := range providerNames(target.Providers) {
+		providers[name] = true
+	}
+
+	for _, resource := range target.Resources {
+		// A reference without an alias is to the default configuration
+		// for that provider, which need not be declared.
+		if strings.Contains(resource.Provider, ".") && !providers[resource.Provider] {
+			v.errorf(
+				target.Name, "resource "+resource.Id(),
+				"resource %s refers to undeclared provider %s",
+				resource.Id(), resource.Provider,
+			)
+		}
+	}
+
+	for _, provider := range target.Providers {
+		v.checkRefs(target, "provider "+provider.FullName(), provider.RawConfig)
+	}
+	for _, module := range target.Modules {
+		v.checkRefs(target, "module "+module.Name, module.RawConfig)
+	}
+	for _, resource := range target.Resources {
+		what := "resource " + resource.Id()
+		v.checkRefs(target, what, resource.RawCount, resource.RawConfig)
+		for _, provisioner := range resource.Provisioners {
+			v.checkRefs(target, what, provisioner.RawConfig, provisioner.ConnInfo)
+		}
+	}
+	for _, output := range target.Outputs {
+		v.checkRefs(target, "output "+output.Name, output.RawConfig)
+	}
+}
+
+// checkRefs reports any interpolations in the given raw configs that refer
+// to variables, resources, modules or target outputs that do not exist.
+//
+// target is the target that the raw configs belong to, or nil for the
+// global provider configurations, which can refer only to variables.
+func (v *configValidator) checkRefs(target *TargetConfig, what string, rawConfigs ...*tfcfg.RawConfig) {
+	var targetName string
+	if target != nil {
+		targetName = target.Name
+	}
+
+	for _, rawConfig := range rawConfigs {
+		if rawConfig == nil {
+			continue
+		}
+
+		keys := make([]string, 0, len(rawConfig.Variables))
+		for k := range rawConfig.Variables {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			switch tv := rawConfig.Variables[k].(type) {
+			case *tfcfg.UserVariable:
+				if !v.hasVariable(tv.Name) {
+					v.errorf(targetName, what, "%s refers to undeclared variable %s", what, tv.Name)
+				}
+
+			case *tfcfg.ModuleVariable:
+				if target == nil || !targetHasModule(target, tv.Name) {
+					v.errorf(targetName, what, "%s refers to undeclared module %s", what, tv.Name)
+				}
+
+			case *tfcfg.ResourceVariable:
+				if isTargetRef(tv) {
+					if err := checkTargetRef(tv); err != nil {
+						v.errorf(targetName, what, "%s: %s", what, err)
+						continue
+					}
+					v.checkTargetRef(targetName, what, tv.Name, tv.Field)
+					continue
+				}
+
+				if target == nil || !targetHasResource(target, tv.ResourceId()) {
+					v.errorf(targetName, what, "%s refers to undeclared resource %s", what, tv.ResourceId())
+				}
+			}
+		}
+	}
+}
+
+func (v *configValidator) checkTargetRef(fromTarget, what, targetName, outputName string) {
+	target := v.config.Target(targetName)
+	if target == nil {
+		v.errorf(fromTarget, what, "%s refers to undeclared target %s", what, targetName)
+		return
+	}
+
+	for _, output := range target.Outputs {
+		if output.Name == outputName {
+			return
+		}
+	}
+	v.errorf(
+		fromTarget, what, "%s refers to undeclared output %s of target %s",
+		what, outputName, targetName,
+	)
+}
+
+func (v *configValidator) hasVariable(name string) bool {
+	for _, variable := range v.config.Variables {
+		if variable.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func targetHasModule(target *TargetConfig, name string) bool {
+	for _, module := range target.Modules {
+		if module.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func targetHasResource(target *TargetConfig, id string) bool {
+	for _, resource := range target.Resources {
+		if resource.Id() == id {
+			return true
+		}
+	}
+	return false
+}
+
+func variableNames(variables []*tfcfg.Variable) []string {
+	ret := make([]string, len(variables))
+	for i, variable := range variables {
+		ret[i] = variable.Name
+	}
+	return ret
+}
+
+func providerNames(providers []*tfcfg.ProviderConfig) []string {
+	ret := make([]string, len(providers))
+	for i, provider := range providers {
+		ret[i] = provider.FullName()
+	}
+	return ret
+}
@@ -0,0 +1,177 @@
+package padstone
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigValidate(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+variable "region" {
+  default = "us-west-2"
+}
+
+provider "aws" {
+  region = "${var.region}"
+}
+
+default_build_targets = ["ami"]
+
+target "ami" {
+  provider "aws" {
+    region = "us-east-1"
+    alias  = "use1"
+  }
+
+  resource "aws_ami_from_instance" "result" {
+    instance_id = "${target.ami_source_instance.id}"
+  }
+
+  resource "aws_ami_copy" "result" {
+    source_ami_id = "${aws_ami_from_instance.result.id}"
+    source_region = "${var.region}"
+    provider      = "aws.use1"
+  }
+
+  output "id" {
+    value = "${aws_ami_copy.result.id}"
+  }
+}
+
+target "ami_source_instance" {
+  module "build_support" {
+    source = "./build_support"
+  }
+
+  data "aws_ami" "ubuntu" {
+    id = "ami-06b94666"
+  }
+
+  resource "aws_instance" "result" {
+    ami       = "${data.aws_ami.ubuntu.id}"
+    subnet_id = "${module.build_support.subnet_id}"
+  }
+
+  output "id" {
+    value = "${aws_instance.result.id}"
+  }
+}
+`), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	if diags := config.Validate(); len(diags) > 0 {
+		t.Fatalf("unexpected diagnostics\n%s", diags)
+	}
+}
+
+func TestConfigValidateErrors(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+variable "region" {}
+variable "region" {}
+
+provider "aws" {
+  region = "${var.regoin}"
+}
+
+target "ami" {
+  module "support" {
+    source = "./support"
+  }
+  module "support" {
+    source = "./support"
+  }
+
+  resource "aws_ami_from_instance" "result" {
+    instance_id = "${target.source.id}"
+    subnet_id   = "${module.suport.subnet_id}"
+  }
+
+  resource "aws_ami_copy" "result" {
+    source_ami_id = "${aws_ami_from_instance.reslt.id}"
+    provider      = "aws.usw2"
+  }
+
+  output "id" {
+    value = "${target.source_instance.instance_id}"
+  }
+  output "id" {
+    value = "${aws_ami_copy.result.id}"
+  }
+}
+
+target "source_instance" {
+  output "id" {
+    value = "i-12345"
+  }
+}
+`), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	var got []string
+	for _, diag := range config.Validate() {
+		got = append(got, diag.Error())
+	}
+
+	want := []string{
+		"padstone.hcl:3:10: variable region is declared more than once",
+		"padstone.hcl:5:10: provider aws refers to undeclared variable regoin",
+		"padstone.hcl:13:10: target ami: module support is declared more than once",
+		"padstone.hcl:30:10: target ami: output id is declared more than once",
+		"padstone.hcl:22:12: target ami: resource aws_ami_copy.result refers to undeclared provider aws.usw2",
+		"padstone.hcl:17:12: target ami: resource aws_ami_from_instance.result refers to undeclared module suport",
+		"padstone.hcl:17:12: target ami: resource aws_ami_from_instance.result refers to undeclared target source",
+		"padstone.hcl:22:12: target ami: resource aws_ami_copy.result refers to undeclared resource aws_ami_from_instance.reslt",
+		"padstone.hcl:27:10: target ami: output id refers to undeclared output instance_id of target source_instance",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong diagnostics\ngot:\n%#v\nwant:\n%#v", got, want)
+	}
+}
+
+func TestConfigValidateCycle(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+target "a" {
+  output "x" {
+    value = "${target.b.x}"
+  }
+}
+target "b" {
+  output "x" {
+    value = "${target.a.x}"
+  }
+}
+`), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	diags := config.Validate()
+	if got, want := len(diags), 1; got != want {
+		t.Fatalf("got %d diagnostics; want %d\n%s", got, want, diags)
+	}
+	if got, want := diags[0].Message, "targets have a dependency cycle: a -> b -> a"; got != want {
+		t.Fatalf("got %q; want %q", got, want)
+	}
+}
+
+func TestConfigValidateDir(t *testing.T) {
+	dir := filepath.Join("test-fixtures", "dir-invalid")
+	config, err := LoadConfig(dir)
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %s", err)
+	}
+
+	diags := config.Validate()
+	if got, want := len(diags), 1; got != want {
+		t.Fatalf("got %d diagnostics; want %d\n%s", got, want, diags)
+	}
+	want := filepath.Join(dir, "ami.padstone") + ":2:10: target ami: output id refers to undeclared variable verison"
+	if got := diags[0].Error(); got != want {
+		t.Fatalf("got %q; want %q", got, want)
+	}
+}
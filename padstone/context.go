@@ -0,0 +1,972 @@
+package padstone
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	getter "github.com/hashicorp/go-getter"
+	multierror "github.com/hashicorp/go-multierror"
+	tfcfg "github.com/hashicorp/terraform/config"
+	tfmod "github.com/hashicorp/terraform/config/module"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// Context is the main entry point for running operations against a
+// configuration, analogous to Terraform's own terraform.Context.
+//
+// The exported fields must be populated before calling any methods, and
+// must not be modified afterwards.
+type Context struct {
+	Config *Config
+
+	// Targets is the names of the targets that are to be kept once a build
+	// is complete. Any other targets they depend on are built as temporary
+	// targets. If this is empty, all targets are kept.
+	Targets []string
+
+	// State is the state to begin from. For a new build this is an empty
+	// state, while for Destroy it is the result state of an earlier build.
+	// Build can also continue from the partial state of an earlier build
+	// that did not complete.
+	State *terraform.State
+
+	Providers     map[string]terraform.ResourceProviderFactory
+	Provisioners  map[string]terraform.ResourceProvisionerFactory
+	Variables     map[string]string
+	Hooks         []terraform.Hook
+	UIInput       terraform.UIInput
+	ModuleStorage getter.Storage
+
+	// Parallelism is the maximum number of targets that Build will build
+	// at once. If it is less than one, targets are built one at a time.
+	Parallelism int
+
+	// SavedPlan, if set, is a plan from an earlier call to Plan that Build
+	// is to execute. Targets and Variables should be set to those of the
+	// plan.
+	SavedPlan *Plan
+
+	// ResultState is the state that results from the most recent operation.
+	// It is populated by Build, CleanUp and Destroy, and is updated as each
+	// target's state changes so that it is valid even if an operation fails
+	// part-way through.
+	ResultState *terraform.State
+
+	prepareOnce sync.Once
+	prepareErr  error
+	graph       *TargetGraph
+	selection   *TargetSelection
+	trees       map[string]*tfmod.Tree
+
+	stateLock sync.Mutex
+
+	stopLock   sync.Mutex
+	stopped    bool
+	incomplete map[string]bool
+}
+
+// ErrInterrupted is returned by Build when it stops early because Stop was
+// called.
+var ErrInterrupted = errors.New("build was interrupted")
+
+// InterruptedError is returned by Build instead of ErrInterrupted when it
+// was interrupted after other targets being built at the same time had
+// already failed. Err describes those failures.
+type InterruptedError struct {
+	Err error
+}
+
+func (e *InterruptedError) Error() string {
+	return fmt.Sprintf("%s, and %s", ErrInterrupted, e.Err)
+}
+
+// IsInterrupted returns true if the given error from Build means that the
+// build was interrupted, whether or not other targets also failed.
+func IsInterrupted(err error) bool {
+	if err == ErrInterrupted {
+		return true
+	}
+	_, ok := err.(*InterruptedError)
+	return ok
+}
+
+// Validate checks the configuration for errors, both in Padstone's own
+// target structure and in the Terraform configuration of each target, and
+// returns diagnostics describing any problems.
+//
+// Validate does not create any resources or need any credentials, but it
+// does load any modules that the targets refer to, using ModuleStorage,
+// and asks the providers to validate the resources that use them.
+//
+// Variables that are required but not set in Variables are assumed to
+// have unknown values, since they may yet be provided via UIInput.
+func (c *Context) Validate() Diagnostics {
+	// The static checks give clearer messages for mistakes in the target
+	// structure than Terraform would, so there's no point continuing
+	// if they fail.
+	diags := c.Config.Validate()
+	if diags.HasErrors() {
+		return diags
+	}
+
+	if err := c.prepare(); err != nil {
+		return append(diags, &Diagnostic{
+			Severity: DiagnosticError,
+			Message:  err.Error(),
+		})
+	}
+
+	order, err := c.graph.Order()
+	if err != nil {
+		return append(diags, &Diagnostic{
+			Severity: DiagnosticError,
+			Message:  err.Error(),
+		})
+	}
+
+	for _, name := range order {
+		tfctx, err := c.terraformContext(name, opValidate)
+		if err != nil {
+			diags = append(diags, &Diagnostic{
+				Severity: DiagnosticError,
+				Message:  err.Error(),
+				Target:   name,
+			})
+			continue
+		}
+
+		warns, errs := tfctx.Validate()
+		for _, warn := range warns {
+			diags = append(diags, &Diagnostic{
+				Severity: DiagnosticWarning,
+				Message:  warn,
+				Target:   name,
+			})
+		}
+		for _, err := range flattenErrors(errs) {
+			diags = append(diags, &Diagnostic{
+				Severity: DiagnosticError,
+				Message:  err.Error(),
+				Target:   name,
+			})
+		}
+	}
+
+	return diags
+}
+
+// Build creates the resources for all of the selected targets and their
+// dependencies. Each target is built only once all of the targets it
+// depends on are complete, and up to Parallelism targets that do not
+// depend on one another are built at once.
+//
+// If a target fails, no more targets are started, but those already in
+// progress are allowed to finish. The resources of temporary targets
+// remain in ResultState after Build returns, and must be destroyed by
+// calling CleanUp. If Build fails or is interrupted, CleanUp also destroys
+// whatever was created for the targets that were being built at the time.
+//
+// If State already contains targets from an earlier build that did not
+// complete, Build continues that build. A target in State is assumed to
+// be complete if any target that depends on it is also in State, and
+// Build fails without changing anything if such a target would now be
+// changed, since that means the configuration or variables are no longer
+// those it was built with. Any other target in State is built again to
+// finish it off.
+//
+// Build records the build's metadata, which can be read with
+// StateMetadata, in ResultState alongside the targets. Any metadata already
+// in State, such as that set by the caller with SetStateMetadata, is kept.
+func (c *Context) Build() error {
+	if err := c.prepare(); err != nil {
+		return err
+	}
+
+	c.ResultState = c.State
+	if c.ResultState == nil {
+		c.ResultState = terraform.NewState()
+	}
+
+	complete, err := c.completeTargets()
+	if err != nil {
+		return err
+	}
+
+	err = c.recordBuildStart()
+	if err != nil {
+		return err
+	}
+
+	parallelism := c.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	sem := make(chan struct{}, parallelism)
+
+	done := make(map[string]chan struct{}, len(c.selection.Order))
+	for _, name := range c.selection.Order {
+		done[name] = make(chan struct{})
+	}
+
+	var lock sync.Mutex
+	succeeded := make(map[string]bool)
+	errs := make(map[string]error)
+
+	var wg sync.WaitGroup
+	for _, name := range c.selection.Order {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			defer close(done[name])
+
+			deps := c.graph.Dependencies(name)
+			for _, dep := range deps {
+				<-done[dep]
+			}
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			lock.Lock()
+			ready := len(errs) == 0
+			for _, dep := range deps {
+				ready = ready && succeeded[dep]
+			}
+			lock.Unlock()
+			if !ready || c.isStopped() {
+				return
+			}
+
+			err := c.buildTarget(name, complete[name])
+
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				errs[name] = err
+			} else {
+				succeeded[name] = true
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	var result error
+	interrupted := false
+	for _, name := range c.selection.Order {
+		err := errs[name]
+		switch {
+		case err == nil:
+			continue
+		case err == ErrInterrupted:
+			interrupted = true
+		default:
+			result = multierror.Append(result, fmt.Errorf("error building target %s: %s", name, err))
+		}
+	}
+	if merr, ok := result.(*multierror.Error); ok && len(merr.Errors) == 1 {
+		result = merr.Errors[0]
+	}
+	switch {
+	case interrupted && result != nil:
+		return &InterruptedError{Err: result}
+	case interrupted:
+		return ErrInterrupted
+	case result == nil && c.isStopped():
+		result = ErrInterrupted
+	}
+
+	if result == nil {
+		result = c.updateMetadata(func(meta *BuildMetadata) {
+			meta.FinishedAt = time.Now().UTC()
+		})
+	}
+
+	return result
+}
+
+// recordBuildStart records what is known about a build before it starts in
+// the metadata of ResultState. A build that is resumed keeps its original
+// ID and start time.
+func (c *Context) recordBuildStart() error {
+	buildID, err := NewBuildID()
+	if err != nil {
+		return err
+	}
+
+	variables := make(map[string]interface{})
+	for _, variable := range c.Config.Variables {
+		if looksSecret(variable.Name) {
+			continue
+		}
+		if value, isSet := c.Variables[variable.Name]; isSet {
+			variables[variable.Name] = value
+		} else if variable.Default != nil {
+			variables[variable.Name] = variable.Default
+		}
+	}
+
+	return c.updateMetadata(func(meta *BuildMetadata) {
+		if meta.BuildID == "" {
+			meta.BuildID = buildID
+		}
+		if meta.StartedAt.IsZero() {
+			meta.StartedAt = time.Now().UTC()
+		}
+		meta.FinishedAt = time.Time{}
+		meta.PadstoneVersion = Version
+		meta.Targets = c.selection.Kept
+		meta.TemporaryTargets = c.selection.Temporary
+		meta.Variables = variables
+	})
+}
+
+// updateMetadata calls the given function to modify the metadata recorded
+// in ResultState.
+func (c *Context) updateMetadata(update func(meta *BuildMetadata)) error {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	meta, err := StateMetadata(c.ResultState)
+	if err != nil {
+		return err
+	}
+	update(meta)
+	return SetStateMetadata(c.ResultState, meta)
+}
+
+// buildTarget builds the target with the given name as part of Build. If
+// the target was completed by an earlier build it is only checked to make
+// sure it would not be changed.
+func (c *Context) buildTarget(name string, complete bool) error {
+	if complete {
+		changes, err := c.targetChanges(name)
+		if err != nil {
+			return err
+		}
+		if len(changes) > 0 {
+			return fmt.Errorf(
+				"it was completed by the earlier build, but would now be changed; the configuration or variables must have changed since it was built:\n%s",
+				formatResourceChanges(changes),
+			)
+		}
+		return nil
+	}
+
+	err := c.applyTarget(name, false)
+	c.updateRootOutputs()
+	if err == nil && c.isStopped() {
+		// Terraform stops early without an error when it is
+		// interrupted, so the target may be only partially built.
+		err = ErrInterrupted
+	}
+	if err != nil {
+		c.stopLock.Lock()
+		if c.incomplete == nil {
+			c.incomplete = make(map[string]bool)
+		}
+		c.incomplete[name] = true
+		c.stopLock.Unlock()
+	}
+
+	return err
+}
+
+// completeTargets returns the names of the targets in State that are
+// known to have been completed by an earlier build, because a target that
+// depends on them was started.
+func (c *Context) completeTargets() (map[string]bool, error) {
+	selected := make(map[string]bool, len(c.selection.Order))
+	for _, name := range c.selection.Order {
+		selected[name] = true
+	}
+
+	complete := make(map[string]bool)
+	for _, name := range StateTargetNames(c.ResultState) {
+		if !selected[name] {
+			return nil, fmt.Errorf("state contains target %s, which is not selected to be built", name)
+		}
+		for _, dep := range c.graph.Dependencies(name) {
+			complete[dep] = true
+		}
+	}
+
+	return complete, nil
+}
+
+// CleanUp destroys the resources of the temporary targets that were
+// created by an earlier call to Build, leaving only the kept targets in
+// ResultState.
+//
+// If Build did not complete, CleanUp also destroys any target that it
+// left partially built, and skips any temporary targets that it never
+// reached.
+func (c *Context) CleanUp() error {
+	return c.cleanUp(false)
+}
+
+// CleanUpAll destroys all of the resources that were created by an earlier
+// call to Build, including those of the kept targets, leaving nothing in
+// ResultState. It is intended for abandoning a build that failed.
+func (c *Context) CleanUpAll() error {
+	return c.cleanUp(true)
+}
+
+func (c *Context) cleanUp(all bool) error {
+	if err := c.prepare(); err != nil {
+		return err
+	}
+
+	inState := make(map[string]bool)
+	c.stateLock.Lock()
+	for _, name := range StateTargetNames(c.ResultState) {
+		inState[name] = true
+	}
+	c.stateLock.Unlock()
+
+	c.stopLock.Lock()
+	incomplete := c.incomplete
+	c.stopLock.Unlock()
+
+	order := c.selection.Order
+	for i := len(order) - 1; i >= 0; i-- {
+		name := order[i]
+		temporary := c.selection.IsTemporary(name)
+		if !inState[name] || !(all || temporary || incomplete[name]) {
+			continue
+		}
+
+		err := c.applyTarget(name, true)
+		c.updateRootOutputs()
+		if err != nil {
+			switch {
+			case temporary:
+				return fmt.Errorf("error destroying temporary target %s: %s", name, err)
+			case incomplete[name]:
+				return fmt.Errorf("error destroying partially-built target %s: %s", name, err)
+			default:
+				return fmt.Errorf("error destroying target %s: %s", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// KeepTemporary removes the temporary targets created by an earlier call
+// to Build from ResultState without destroying them, and returns them as
+// a separate result state. This is an alternative to CleanUp for when the
+// temporary resources are needed for debugging. They can be destroyed
+// later by passing the returned state to Destroy.
+func (c *Context) KeepTemporary() (*terraform.State, error) {
+	if err := c.prepare(); err != nil {
+		return nil, err
+	}
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	ret := terraform.NewState()
+	for _, name := range c.selection.Temporary {
+		if c.ResultState.ModuleByPath([]string{"root", name}) == nil {
+			continue
+		}
+		SetTargetState(ret, name, TargetState(c.ResultState, name))
+		RemoveTargetState(c.ResultState, name)
+	}
+
+	// The returned state needs the same means of being destroyed as the
+	// result state, but is not itself a build.
+	meta, err := StateMetadata(c.ResultState)
+	if err != nil {
+		return nil, err
+	}
+	err = SetStateMetadata(ret, &BuildMetadata{
+		BuildID:          meta.BuildID,
+		TemporaryTargets: meta.TemporaryTargets,
+		ConfigPath:       meta.ConfigPath,
+		ConfigHash:       meta.ConfigHash,
+		Snapshot:         meta.Snapshot,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// IncompleteTargets returns the names of the kept targets that Build left
+// partially built and that are still recorded in ResultState, in the order
+// they were built. After CleanUp these are the kept targets that it failed
+// to destroy, since KeepTemporary does not remove them from ResultState.
+func (c *Context) IncompleteTargets() []string {
+	if err := c.prepare(); err != nil {
+		return nil
+	}
+
+	c.stopLock.Lock()
+	incomplete := c.incomplete
+	c.stopLock.Unlock()
+
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	var ret []string
+	for _, name := range c.selection.Order {
+		if !incomplete[name] || c.selection.IsTemporary(name) {
+			continue
+		}
+		if c.ResultState.ModuleByPath([]string{"root", name}) == nil {
+			continue
+		}
+		ret = append(ret, name)
+	}
+	return ret
+}
+
+// Stop asks a running Build to stop as soon as possible. Operations on
+// resources that are already in progress are allowed to finish, but no
+// new ones are started, and Build then returns ErrInterrupted, or an
+// InterruptedError if other targets had already failed.
+//
+// Stop may be called from any goroutine, and returns immediately. It does
+// not affect CleanUp or Destroy, so that the resources created by an
+// interrupted build can still be cleaned up.
+func (c *Context) Stop() {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+
+	c.stopped = true
+}
+
+func (c *Context) isStopped() bool {
+	c.stopLock.Lock()
+	defer c.stopLock.Unlock()
+
+	return c.stopped
+}
+
+// CurrentState returns a copy of ResultState that is safe to use while an
+// operation is running in another goroutine, or nil if no operation has
+// started.
+func (c *Context) CurrentState() *terraform.State {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if c.ResultState == nil {
+		return nil
+	}
+	return c.ResultState.DeepCopy()
+}
+
+// Destroy destroys all of the resources in State, in the reverse of the
+// order in which their targets were built.
+//
+// State is updated in-place, and ResultState refers to the same object.
+func (c *Context) Destroy() error {
+	if err := c.prepare(); err != nil {
+		return err
+	}
+
+	c.ResultState = c.State
+
+	inState := make(map[string]bool)
+	for _, name := range StateTargetNames(c.ResultState) {
+		if c.Config.Target(name) == nil {
+			return fmt.Errorf("state contains target %s, which is not in the configuration", name)
+		}
+		inState[name] = true
+	}
+
+	order, err := c.graph.Order()
+	if err != nil {
+		return err
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		name := order[i]
+		if !inState[name] {
+			continue
+		}
+
+		err := c.applyTarget(name, true)
+		c.updateRootOutputs()
+		if err != nil {
+			return fmt.Errorf("error destroying target %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// prepare does the work that is common to all operations: building the
+// target graph, deciding which targets to build, and loading the module
+// tree for each target. It is safe to call prepare multiple times.
+func (c *Context) prepare() error {
+	c.prepareOnce.Do(func() {
+		c.prepareErr = c.doPrepare()
+	})
+	return c.prepareErr
+}
+
+func (c *Context) doPrepare() error {
+	var err error
+
+	c.graph, err = c.Config.TargetGraph()
+	if err != nil {
+		return err
+	}
+
+	targets := c.Targets
+	if len(targets) == 0 {
+		targets, err = c.graph.Order()
+		if err != nil {
+			return err
+		}
+	}
+	c.selection, err = c.graph.Select(targets)
+	if err != nil {
+		return err
+	}
+
+	if c.SavedPlan != nil {
+		for _, name := range c.selection.Order {
+			if c.SavedPlan.TargetPlans[name] == nil {
+				return fmt.Errorf("saved plan does not include target %s", name)
+			}
+		}
+	}
+
+	c.trees, err = c.Config.TargetModuleTrees()
+	if err != nil {
+		return err
+	}
+
+	for name, tree := range c.trees {
+		err := tree.Load(c.ModuleStorage, tfmod.GetModeGet)
+		if err != nil {
+			return fmt.Errorf("error loading modules for target %s: %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// applyTarget creates or destroys the resources for a single target,
+// recording the result in ResultState.
+func (c *Context) applyTarget(name string, destroy bool) error {
+	var tfctx *terraform.Context
+	var err error
+
+	if c.SavedPlan != nil && !destroy {
+		tfctx, err = c.planTarget(name)
+		if err != nil {
+			return err
+		}
+	} else {
+		op := opApply
+		if destroy {
+			op = opDestroy
+		}
+
+		tfctx, err = c.terraformContext(name, op)
+		if err != nil {
+			return err
+		}
+
+		if err := c.input(tfctx); err != nil {
+			return err
+		}
+
+		_, err = tfctx.Plan()
+		if err != nil {
+			return err
+		}
+	}
+
+	if !destroy {
+		if err := c.recordSnapshot(name, tfctx); err != nil {
+			return err
+		}
+	}
+
+	newState, applyErr := tfctx.Apply()
+	if newState != nil {
+		c.setTargetState(name, newState, destroy)
+	}
+
+	return applyErr
+}
+
+// recordSnapshot records the provider configuration of the target with the
+// given name, from the given context that is about to build it, in the
+// metadata of ResultState.
+func (c *Context) recordSnapshot(name string, tfctx *terraform.Context) error {
+	snapshot := snapshotTarget(name, tfctx)
+
+	return c.updateMetadata(func(meta *BuildMetadata) {
+		if meta.Snapshot == nil {
+			meta.Snapshot = &ConfigSnapshot{}
+		}
+		meta.Snapshot.setTarget(snapshot, c.selection.Order)
+	})
+}
+
+// targetChanges plans the target with the given name as it would be
+// built, and returns the changes it would make.
+func (c *Context) targetChanges(name string) ([]ResourceChange, error) {
+	tfctx, err := c.terraformContext(name, opApply)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.input(tfctx); err != nil {
+		return nil, err
+	}
+
+	plan, err := tfctx.Plan()
+	if err != nil {
+		return nil, err
+	}
+
+	return diffResourceChanges(plan.Diff), nil
+}
+
+// input asks for any variables and provider settings that the given
+// Terraform context needs, if there is a UIInput to ask with.
+func (c *Context) input(tfctx *terraform.Context) error {
+	if c.UIInput == nil {
+		return nil
+	}
+	return tfctx.Input(terraform.InputModeVar | terraform.InputModeVarUnset | terraform.InputModeProvider)
+}
+
+// contextOp is the operation that a Terraform context is created for.
+type contextOp int
+
+const (
+	opValidate contextOp = iota
+	opPlan
+	opApply
+	opDestroy
+)
+
+// terraformContext creates a Terraform context for the target with the
+// given name, for the given operation.
+//
+// References to the outputs of other targets are populated from the
+// targets' portions of the current state. When validating, or when
+// planning or destroying while the referenced target isn't in the state,
+// unknown values are used instead.
+//
+// When applying a target from SavedPlan, the module tree and variables
+// are taken from the saved plan rather than from the configuration.
+func (c *Context) terraformContext(name string, op contextOp) (*terraform.Context, error) {
+	target := c.Config.Target(name)
+	module := c.trees[name]
+
+	variables := make(map[string]interface{}, len(c.Variables))
+	for k, v := range c.Variables {
+		variables[k] = v
+	}
+
+	if saved := c.savedTargetPlan(name); saved != nil && op == opApply {
+		module = saved.Module
+		variables = make(map[string]interface{}, len(saved.Vars))
+		for k, v := range saved.Vars {
+			variables[k] = v
+		}
+	}
+
+	c.stateLock.Lock()
+	currentState := c.ResultState
+	if currentState == nil {
+		currentState = c.State
+	}
+	outputs := map[string]map[string]interface{}{}
+	var state *terraform.State
+	if currentState != nil {
+		outputs = TargetOutputs(currentState)
+		state = TargetState(currentState, name)
+	}
+	c.stateLock.Unlock()
+
+	switch op {
+	case opValidate:
+		for _, ref := range target.TargetOutputRefs() {
+			variables[ref.VariableName()] = tfcfg.UnknownVariableValue
+		}
+		for _, variable := range c.Config.Variables {
+			_, isSet := variables[variable.Name]
+			if !isSet && variable.Required() && variable.Type() == tfcfg.VariableTypeString {
+				variables[variable.Name] = tfcfg.UnknownVariableValue
+			}
+		}
+	case opPlan, opDestroy:
+		for _, ref := range target.TargetOutputRefs() {
+			if v, exists := outputs[ref.Target][ref.Output]; exists {
+				variables[ref.VariableName()] = v
+			} else {
+				variables[ref.VariableName()] = tfcfg.UnknownVariableValue
+			}
+		}
+	default:
+		upstream, err := target.UpstreamVariables(outputs)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range upstream {
+			variables[k] = v
+		}
+	}
+
+	return terraform.NewContext(&terraform.ContextOpts{
+		Destroy:      op == opDestroy,
+		Hooks:        c.targetHooks(name, op == opDestroy),
+		Module:       module,
+		State:        state,
+		Providers:    c.Providers,
+		Provisioners: c.Provisioners,
+		Variables:    variables,
+		UIInput:      c.UIInput,
+	})
+}
+
+// savedTargetPlan returns the saved plan for the target with the given
+// name, or nil if there is no saved plan.
+func (c *Context) savedTargetPlan(name string) *terraform.Plan {
+	if c.SavedPlan == nil {
+		return nil
+	}
+	return c.SavedPlan.TargetPlans[name]
+}
+
+// targetHooks wraps each of the caller's hooks for use with the Terraform
+// context of the target with the given name.
+//
+// When building, the hooks also include one that halts Terraform if Stop
+// is called.
+func (c *Context) targetHooks(name string, destroy bool) []terraform.Hook {
+	var hooks []terraform.Hook
+	if !destroy {
+		hooks = append(hooks, &interruptHook{ctx: c})
+	}
+	for _, hook := range c.Hooks {
+		if th, ok := hook.(TargetHook); ok {
+			hook = th.ForTarget(name)
+		}
+		hooks = append(hooks, &targetHook{
+			Hook:       hook,
+			ctx:        c,
+			targetName: name,
+			destroy:    destroy,
+		})
+	}
+	return hooks
+}
+
+// setTargetState records the given state as the current state of the
+// target with the given name. When destroying, a target with no remaining
+// resources is removed from ResultState altogether.
+func (c *Context) setTargetState(name string, state *terraform.State, destroy bool) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	if !destroy || state.HasResources() {
+		SetTargetState(c.ResultState, name, state)
+	} else {
+		RemoveTargetState(c.ResultState, name)
+	}
+}
+
+// updateRootOutputs sets the outputs of the root module of ResultState to
+// the outputs of the kept targets that are present in it.
+func (c *Context) updateRootOutputs() {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+
+	var names []string
+	for _, name := range StateTargetNames(c.ResultState) {
+		if !c.selection.IsTemporary(name) {
+			names = append(names, name)
+		}
+	}
+
+	SetRootOutputs(c.ResultState, names)
+}
+
+// TargetHook is implemented by hooks that need to know which target each
+// call relates to, since targets may be built concurrently. Such a hook is
+// not called directly; instead, ForTarget is called to obtain a hook for
+// each target.
+type TargetHook interface {
+	terraform.Hook
+
+	ForTarget(name string) terraform.Hook
+}
+
+// targetHook wraps a caller-provided hook so that state updates for an
+// individual target are reported to it as updates to the whole result
+// state.
+type targetHook struct {
+	terraform.Hook
+
+	ctx        *Context
+	targetName string
+	destroy    bool
+}
+
+func (h *targetHook) PostStateUpdate(state *terraform.State) (terraform.HookAction, error) {
+	h.ctx.setTargetState(h.targetName, state, h.destroy)
+
+	h.ctx.stateLock.Lock()
+	defer h.ctx.stateLock.Unlock()
+
+	return h.Hook.PostStateUpdate(h.ctx.ResultState)
+}
+
+// interruptHook halts Terraform before it begins any new operation on a
+// resource once Stop has been called, leaving operations that are already
+// in progress to finish.
+type interruptHook struct {
+	terraform.NilHook
+
+	ctx *Context
+}
+
+func (h *interruptHook) PreApply(*terraform.InstanceInfo, *terraform.InstanceState, *terraform.InstanceDiff) (terraform.HookAction, error) {
+	return h.action(), nil
+}
+
+func (h *interruptHook) PreDiff(*terraform.InstanceInfo, *terraform.InstanceState) (terraform.HookAction, error) {
+	return h.action(), nil
+}
+
+func (h *interruptHook) PreProvisionResource(*terraform.InstanceInfo, *terraform.InstanceState) (terraform.HookAction, error) {
+	return h.action(), nil
+}
+
+func (h *interruptHook) PreRefresh(*terraform.InstanceInfo, *terraform.InstanceState) (terraform.HookAction, error) {
+	return h.action(), nil
+}
+
+func (h *interruptHook) action() terraform.HookAction {
+	if h.ctx.isStopped() {
+		return terraform.HookActionHalt
+	}
+	return terraform.HookActionContinue
+}
+
+// flattenErrors expands any multierrors in the given list into their
+// individual errors, so that each can be reported separately.
+func flattenErrors(errs []error) []error {
+	var ret []error
+	for _, err := range errs {
+		if multi, ok := err.(*multierror.Error); ok {
+			ret = append(ret, flattenErrors(multi.Errors)...)
+			continue
+		}
+		ret = append(ret, err)
+	}
+	return ret
+}
@@ -0,0 +1,694 @@
+package padstone
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestContextBuild(t *testing.T) {
+	config, err := ParseConfig([]byte(contextTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	provider := testProvider()
+	ctx := &Context{
+		Config:  config,
+		Targets: config.DefaultBuildTargets,
+		State:   terraform.NewState(),
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+
+	if diags := ctx.Validate(); len(diags) > 0 {
+		t.Fatalf("unexpected validation problems\n%s", diags)
+	}
+
+	err = ctx.Build()
+	if err != nil {
+		t.Fatalf("unexpected error building: %s", err)
+	}
+
+	if got, want := StateTargetNames(ctx.ResultState), []string{"image", "instance"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after build got targets %#v; want %#v", got, want)
+	}
+
+	image := ctx.ResultState.ModuleByPath([]string{"root", "image"}).Resources["test_image.result"]
+	if got, want := image.Primary.Attributes["instance_id"], "test_instance.source"; got != want {
+		t.Fatalf("image was built from %q; want %q", got, want)
+	}
+
+	err = ctx.CleanUp()
+	if err != nil {
+		t.Fatalf("unexpected error cleaning up: %s", err)
+	}
+
+	if got, want := StateTargetNames(ctx.ResultState), []string{"image"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after clean up got targets %#v; want %#v", got, want)
+	}
+	if got, want := provider.destroyed(), []string{"test_instance.source"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("destroyed %#v; want %#v", got, want)
+	}
+
+	outputs := ctx.ResultState.RootModule().Outputs
+	if got, want := len(outputs), 1; got != want {
+		t.Fatalf("got %d root outputs; want %d", got, want)
+	}
+	if got, want := outputs["image_id"].Value, "test_image.result"; got != want {
+		t.Fatalf("got image_id output %#v; want %#v", got, want)
+	}
+
+	destroyCtx := &Context{
+		Config: config,
+		State:  ctx.ResultState,
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+
+	err = destroyCtx.Destroy()
+	if err != nil {
+		t.Fatalf("unexpected error destroying: %s", err)
+	}
+
+	if got := StateTargetNames(destroyCtx.State); len(got) != 0 {
+		t.Fatalf("after destroy got targets %#v; want none", got)
+	}
+	if got := destroyCtx.State.RootModule().Outputs; len(got) != 0 {
+		t.Fatalf("after destroy got root outputs %#v; want none", got)
+	}
+}
+
+func TestContextKeepTemporary(t *testing.T) {
+	config, err := ParseConfig([]byte(contextTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	provider := testProvider()
+	ctx := &Context{
+		Config:  config,
+		Targets: config.DefaultBuildTargets,
+		State:   terraform.NewState(),
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+
+	err = ctx.Build()
+	if err != nil {
+		t.Fatalf("unexpected error building: %s", err)
+	}
+
+	tempState, err := ctx.KeepTemporary()
+	if err != nil {
+		t.Fatalf("unexpected error keeping temporary targets: %s", err)
+	}
+
+	if got, want := StateTargetNames(ctx.ResultState), []string{"image"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("result state has targets %#v; want %#v", got, want)
+	}
+	if got, want := StateTargetNames(tempState), []string{"instance"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("temporary state has targets %#v; want %#v", got, want)
+	}
+	if got := provider.destroyed(); len(got) != 0 {
+		t.Fatalf("destroyed %#v; want nothing", got)
+	}
+
+	cleanupCtx := &Context{
+		Config:  config,
+		Targets: StateTargetNames(tempState),
+		State:   tempState,
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+
+	err = cleanupCtx.Destroy()
+	if err != nil {
+		t.Fatalf("unexpected error destroying temporary targets: %s", err)
+	}
+
+	if got, want := provider.destroyed(), []string{"test_instance.source"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("destroyed %#v; want %#v", got, want)
+	}
+}
+
+func TestContextValidate(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+variable "size" {}
+
+target "instance" {
+  resource "test_instance" "source" {
+    size = "${var.size}"
+  }
+
+  output "id" {
+    value = "${test_instance.source.id}"
+  }
+}
+
+target "image" {
+  resource "test_image" "result" {
+    instance_id = "${target.instance.id}"
+  }
+}
+`), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	provider := testProvider()
+	provider.ValidateResourceFn = func(t string, c *terraform.ResourceConfig) ([]string, []error) {
+		if t == "test_image" {
+			return nil, []error{fmt.Errorf("test_image is not supported")}
+		}
+		return nil, nil
+	}
+
+	ctx := &Context{
+		Config: config,
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+
+	// The unset variable and the output of the other target are both
+	// unknown, so the only problem is the one the provider reports.
+	diags := ctx.Validate()
+	if got, want := len(diags), 1; got != want {
+		t.Fatalf("got %d diagnostics; want %d\n%s", got, want, diags)
+	}
+	if got, want := diags[0].Target, "image"; got != want {
+		t.Fatalf("got diagnostic for target %q; want %q", got, want)
+	}
+	if got, want := diags[0].Error(), "target image: test_image.result: test_image is not supported"; got != want {
+		t.Fatalf("got diagnostic %q; want %q", got, want)
+	}
+}
+
+func TestContextBuildInterrupted(t *testing.T) {
+	config, err := ParseConfig([]byte(contextTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	provider := testProvider()
+	ctx := &Context{
+		Config:  config,
+		Targets: config.DefaultBuildTargets,
+		State:   terraform.NewState(),
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+	ctx.Hooks = []terraform.Hook{&stopHook{ctx: ctx, id: "test_image.result"}}
+
+	err = ctx.Build()
+	if err != ErrInterrupted {
+		t.Fatalf("got error %v from build; want %v", err, ErrInterrupted)
+	}
+
+	if got, want := StateTargetNames(ctx.CurrentState()), []string{"image", "instance"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after build got targets %#v; want %#v", got, want)
+	}
+
+	// The kept target was only partially built when the build stopped,
+	// so it is destroyed along with the temporary one.
+	err = ctx.CleanUp()
+	if err != nil {
+		t.Fatalf("unexpected error cleaning up: %s", err)
+	}
+
+	if got := StateTargetNames(ctx.ResultState); len(got) != 0 {
+		t.Fatalf("after clean up got targets %#v; want none", got)
+	}
+	if got, want := provider.destroyed(), []string{"test_image.result", "test_instance.source"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("destroyed %#v; want %#v", got, want)
+	}
+}
+
+func TestContextCleanUpIncompleteFails(t *testing.T) {
+	config, err := ParseConfig([]byte(contextTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	provider := testProvider()
+	apply := provider.ApplyFn
+	provider.ApplyFn = func(info *terraform.InstanceInfo, s *terraform.InstanceState, d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if info.Type == "test_image" && d.Destroy {
+			// As with a real provider, the resource still exists.
+			return s, fmt.Errorf("image is in use")
+		}
+		return apply(info, s, d)
+	}
+
+	ctx := &Context{
+		Config:  config,
+		Targets: config.DefaultBuildTargets,
+		State:   terraform.NewState(),
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+	ctx.Hooks = []terraform.Hook{&stopHook{ctx: ctx, id: "test_image.result"}}
+
+	err = ctx.Build()
+	if err != ErrInterrupted {
+		t.Fatalf("got error %v from build; want %v", err, ErrInterrupted)
+	}
+
+	err = ctx.CleanUp()
+	if err == nil {
+		t.Fatalf("clean up succeeded; want error")
+	}
+
+	// The partially-built kept target stays in the result state, while
+	// the temporary target is moved out of it.
+	leftovers, err := ctx.KeepTemporary()
+	if err != nil {
+		t.Fatalf("unexpected error keeping temporary targets: %s", err)
+	}
+	if got, want := StateTargetNames(leftovers), []string{"instance"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("leftovers have targets %#v; want %#v", got, want)
+	}
+	if got, want := ctx.IncompleteTargets(), []string{"image"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got incomplete targets %#v; want %#v", got, want)
+	}
+	if got, want := StateTargetNames(ctx.ResultState), []string{"image"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("result state has targets %#v; want %#v", got, want)
+	}
+}
+
+func TestContextCleanUpAll(t *testing.T) {
+	config, err := ParseConfig([]byte(contextTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	provider := testProvider()
+	apply := provider.ApplyFn
+	provider.ApplyFn = func(info *terraform.InstanceInfo, s *terraform.InstanceState, d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if info.Type == "test_image" && !d.Destroy {
+			return nil, fmt.Errorf("out of disk space")
+		}
+		return apply(info, s, d)
+	}
+
+	ctx := &Context{
+		Config:  config,
+		Targets: []string{"instance", "image"},
+		State:   terraform.NewState(),
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+
+	err = ctx.Build()
+	if err == nil {
+		t.Fatalf("build succeeded; want error")
+	}
+
+	// The instance target is kept and was built completely, so only
+	// CleanUpAll destroys it.
+	err = ctx.CleanUpAll()
+	if err != nil {
+		t.Fatalf("unexpected error cleaning up: %s", err)
+	}
+
+	if got := StateTargetNames(ctx.ResultState); len(got) != 0 {
+		t.Fatalf("after clean up got targets %#v; want none", got)
+	}
+	if got, want := provider.destroyed(), []string{"test_instance.source"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("destroyed %#v; want %#v", got, want)
+	}
+}
+
+func TestContextBuildResume(t *testing.T) {
+	config, err := ParseConfig([]byte(contextTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	var created []string
+	provider := testProvider()
+	apply := provider.ApplyFn
+	failImage := true
+	provider.ApplyFn = func(info *terraform.InstanceInfo, s *terraform.InstanceState, d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if !d.Destroy {
+			if info.Type == "test_image" && failImage {
+				return nil, fmt.Errorf("out of disk space")
+			}
+			created = append(created, info.Id)
+		}
+		return apply(info, s, d)
+	}
+
+	newContext := func(config *Config, state *terraform.State) *Context {
+		return &Context{
+			Config:  config,
+			Targets: config.DefaultBuildTargets,
+			State:   state,
+			Providers: map[string]terraform.ResourceProviderFactory{
+				"test": terraform.ResourceProviderFactoryFixed(provider),
+			},
+			ModuleStorage: &getter.FolderStorage{
+				StorageDir: t.TempDir(),
+			},
+		}
+	}
+
+	failed := newContext(config, terraform.NewState())
+	if err := failed.Build(); err == nil {
+		t.Fatalf("build succeeded; want error")
+	}
+	if got, want := StateTargetNames(failed.ResultState), []string{"image", "instance"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after failed build got targets %#v; want %#v", got, want)
+	}
+
+	// If the completed target's configuration has changed, the build
+	// can't be resumed.
+	changedConfig, err := ParseConfig([]byte(strings.Replace(contextTestConfig, "large", "small", 1)), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing changed config: %s", err)
+	}
+	err = newContext(changedConfig, failed.ResultState.DeepCopy()).Build()
+	if err == nil {
+		t.Fatalf("resuming with changed config succeeded; want error")
+	}
+	if got, want := err.Error(), "error building target instance: it was completed by the earlier build, but would now be changed"; !strings.Contains(got, want) {
+		t.Fatalf("got error %q; want it to contain %q", got, want)
+	}
+
+	failImage = false
+	resumed := newContext(config, failed.ResultState)
+	if err := resumed.Build(); err != nil {
+		t.Fatalf("unexpected error resuming build: %s", err)
+	}
+
+	// The instance was already complete, so it is not created again.
+	if got, want := created, []string{"test_instance.source", "test_image.result"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("created %#v; want %#v", got, want)
+	}
+
+	image := resumed.ResultState.ModuleByPath([]string{"root", "image"}).Resources["test_image.result"]
+	if got, want := image.Primary.Attributes["instance_id"], "test_instance.source"; got != want {
+		t.Fatalf("image was built from %q; want %q", got, want)
+	}
+}
+
+func TestContextBuildParallel(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+target "east" {
+  resource "test_image" "east" {}
+}
+
+target "west" {
+  resource "test_image" "west" {}
+}
+`), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	// Each image waits for the other to start, so the build can only
+	// succeed if the two targets are built at the same time.
+	started := map[string]chan struct{}{
+		"test_image.east": make(chan struct{}),
+		"test_image.west": make(chan struct{}),
+	}
+	other := map[string]string{
+		"test_image.east": "test_image.west",
+		"test_image.west": "test_image.east",
+	}
+	provider := testProvider()
+	apply := provider.ApplyFn
+	provider.ApplyFn = func(info *terraform.InstanceInfo, s *terraform.InstanceState, d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		close(started[info.Id])
+		select {
+		case <-started[other[info.Id]]:
+		case <-time.After(5 * time.Second):
+			return nil, fmt.Errorf("%s was not built at the same time", other[info.Id])
+		}
+		return apply(info, s, d)
+	}
+
+	hook := &recordTargetsHook{}
+	ctx := &Context{
+		Config: config,
+		State:  terraform.NewState(),
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		Hooks: []terraform.Hook{hook},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+		Parallelism: 2,
+	}
+
+	err = ctx.Build()
+	if err != nil {
+		t.Fatalf("unexpected error building: %s", err)
+	}
+
+	if got, want := StateTargetNames(ctx.ResultState), []string{"east", "west"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after build got targets %#v; want %#v", got, want)
+	}
+	if got, want := hook.targets(), []string{"east", "west"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("hooks were requested for %#v; want %#v", got, want)
+	}
+}
+
+func TestContextBuildInterruptedAfterFailure(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+target "east" {
+  resource "test_image" "east" {}
+}
+
+target "west" {
+  resource "test_image" "west" {}
+}
+`), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	// The east image fails while the west image is being built, and then
+	// the build is interrupted before the west image is finished.
+	var ctx *Context
+	westStarted := make(chan struct{})
+	eastFailed := make(chan struct{})
+	provider := testProvider()
+	apply := provider.ApplyFn
+	provider.ApplyFn = func(info *terraform.InstanceInfo, s *terraform.InstanceState, d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if d.Destroy {
+			return apply(info, s, d)
+		}
+		switch info.Id {
+		case "test_image.east":
+			<-westStarted
+			defer close(eastFailed)
+			return nil, fmt.Errorf("out of disk space")
+		default:
+			close(westStarted)
+			<-eastFailed
+			ctx.Stop()
+			return apply(info, s, d)
+		}
+	}
+
+	ctx = &Context{
+		Config: config,
+		State:  terraform.NewState(),
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+		Parallelism: 2,
+	}
+
+	err = ctx.Build()
+	if !IsInterrupted(err) {
+		t.Fatalf("got error %v from build; want it to be interrupted", err)
+	}
+	interruptErr, ok := err.(*InterruptedError)
+	if !ok {
+		t.Fatalf("got error of type %T; want *InterruptedError", err)
+	}
+	if got, want := interruptErr.Err.Error(), "error building target east:"; !strings.HasPrefix(got, want) {
+		t.Fatalf("got error %q; want it to start with %q", got, want)
+	}
+}
+
+// recordTargetsHook records the names of the targets it is asked for
+// hooks for.
+type recordTargetsHook struct {
+	terraform.NilHook
+
+	mu    sync.Mutex
+	names []string
+}
+
+func (h *recordTargetsHook) ForTarget(name string) terraform.Hook {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.names = append(h.names, name)
+	return &terraform.NilHook{}
+}
+
+func (h *recordTargetsHook) targets() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ret := append([]string{}, h.names...)
+	sort.Strings(ret)
+	return ret
+}
+
+// stopHook stops its context once the resource with the given id has been
+// applied.
+type stopHook struct {
+	terraform.NilHook
+
+	ctx *Context
+	id  string
+}
+
+func (h *stopHook) PostApply(info *terraform.InstanceInfo, s *terraform.InstanceState, err error) (terraform.HookAction, error) {
+	if s != nil && s.ID == h.id {
+		h.ctx.Stop()
+	}
+	return terraform.HookActionContinue, nil
+}
+
+type mockProvider struct {
+	*terraform.MockResourceProvider
+
+	mu           sync.Mutex
+	destroyedIDs []string
+}
+
+// testProvider returns a mock provider whose resources get their id from
+// their type and name, and which copies all of their configuration
+// attributes into their state.
+func testProvider() *mockProvider {
+	p := &mockProvider{
+		MockResourceProvider: new(terraform.MockResourceProvider),
+	}
+
+	p.DiffFn = func(info *terraform.InstanceInfo, s *terraform.InstanceState, c *terraform.ResourceConfig) (*terraform.InstanceDiff, error) {
+		diff := &terraform.InstanceDiff{
+			Attributes: map[string]*terraform.ResourceAttrDiff{},
+		}
+		for k, v := range c.Config {
+			newVal := fmt.Sprintf("%v", v)
+			if s != nil && s.Attributes[k] == newVal {
+				continue
+			}
+			diff.Attributes[k] = &terraform.ResourceAttrDiff{
+				New: newVal,
+			}
+		}
+		if s == nil || s.ID == "" {
+			diff.Attributes["id"] = &terraform.ResourceAttrDiff{
+				NewComputed: true,
+				RequiresNew: true,
+			}
+		}
+		return diff, nil
+	}
+
+	p.ApplyFn = func(info *terraform.InstanceInfo, s *terraform.InstanceState, d *terraform.InstanceDiff) (*terraform.InstanceState, error) {
+		if d.Destroy {
+			p.mu.Lock()
+			p.destroyedIDs = append(p.destroyedIDs, s.ID)
+			p.mu.Unlock()
+			return nil, nil
+		}
+
+		id := info.Id
+		ret := &terraform.InstanceState{
+			ID:         id,
+			Attributes: map[string]string{"id": id},
+		}
+		for k, attr := range d.Attributes {
+			if !attr.NewComputed {
+				ret.Attributes[k] = attr.New
+			}
+		}
+		return ret, nil
+	}
+
+	return p
+}
+
+func (p *mockProvider) destroyed() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ret := append([]string{}, p.destroyedIDs...)
+	sort.Strings(ret)
+	return ret
+}
+
+const contextTestConfig = `
+default_build_targets = ["image"]
+
+target "instance" {
+  resource "test_instance" "source" {
+    size = "large"
+  }
+
+  output "id" {
+    value = "${test_instance.source.id}"
+  }
+}
+
+target "image" {
+  resource "test_image" "result" {
+    instance_id = "${target.instance.id}"
+  }
+
+  output "image_id" {
+    value = "${test_image.result.id}"
+  }
+}
+`
@@ -0,0 +1,148 @@
+package padstone
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/hashicorp/hcl/hcl/token"
+)
+
+// DiagnosticSeverity distinguishes problems that prevent a configuration
+// from being used from those that are merely suspicious.
+type DiagnosticSeverity int
+
+const (
+	DiagnosticError DiagnosticSeverity = iota
+	DiagnosticWarning
+)
+
+func (s DiagnosticSeverity) String() string {
+	switch s {
+	case DiagnosticError:
+		return "error"
+	case DiagnosticWarning:
+		return "warning"
+	default:
+		return fmt.Sprintf("DiagnosticSeverity(%d)", int(s))
+	}
+}
+
+// Diagnostic describes a single problem with a configuration, along with
+// where in the configuration it was found.
+//
+// Filename, Line and Column are as precise as is known for the problem in
+// question; Line and Column are zero if the position within the file is
+// not known, and Filename is empty if the problem isn't specific to a file.
+//
+// Target is the name of the target that the problem relates to, or empty
+// if it isn't specific to one target.
+type Diagnostic struct {
+	Severity DiagnosticSeverity
+	Message  string
+
+	Filename string
+	Line     int
+	Column   int
+
+	Target string
+}
+
+// Error returns the message prefixed with the position of the problem, in
+// the conventional "filename:line:column: message" format, and with the
+// name of the target it relates to, if any.
+func (d *Diagnostic) Error() string {
+	var pos string
+	switch {
+	case d.Filename != "" && d.Line > 0:
+		pos = fmt.Sprintf("%s:%d:%d: ", d.Filename, d.Line, d.Column)
+	case d.Filename != "":
+		pos = d.Filename + ": "
+	case d.Line > 0:
+		pos = fmt.Sprintf("%d:%d: ", d.Line, d.Column)
+	}
+	if d.Target != "" {
+		pos += fmt.Sprintf("target %s: ", d.Target)
+	}
+	return pos + d.Message
+}
+
+// Diagnostics is a list of problems with a configuration. It implements
+// error so that it can be returned from functions that return an error,
+// and callers that want the individual problems can use a type assertion
+// to recover it.
+type Diagnostics []*Diagnostic
+
+// Error returns the messages of all of the diagnostics, one per line.
+func (d Diagnostics) Error() string {
+	var buf bytes.Buffer
+	for i, diag := range d {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(diag.Error())
+	}
+	return buf.String()
+}
+
+// HasErrors returns true if any of the diagnostics are errors rather than
+// warnings.
+func (d Diagnostics) HasErrors() bool {
+	for _, diag := range d {
+		if diag.Severity == DiagnosticError {
+			return true
+		}
+	}
+	return false
+}
+
+// Errors returns only the diagnostics that are errors.
+func (d Diagnostics) Errors() Diagnostics {
+	return d.filter(DiagnosticError)
+}
+
+// Warnings returns only the diagnostics that are warnings.
+func (d Diagnostics) Warnings() Diagnostics {
+	return d.filter(DiagnosticWarning)
+}
+
+// Err returns the error diagnostics as an error, or nil if there are none.
+// This avoids returning a nil Diagnostics in a non-nil error interface.
+func (d Diagnostics) Err() error {
+	if !d.HasErrors() {
+		return nil
+	}
+	return d.Errors()
+}
+
+func (d Diagnostics) filter(severity DiagnosticSeverity) Diagnostics {
+	var ret Diagnostics
+	for _, diag := range d {
+		if diag.Severity == severity {
+			ret = append(ret, diag)
+		}
+	}
+	return ret
+}
+
+// setFilename sets the filename of any of the diagnostics that don't
+// already have one.
+func (d Diagnostics) setFilename(filename string) {
+	for _, diag := range d {
+		if diag.Filename == "" {
+			diag.Filename = filename
+		}
+	}
+}
+
+// diagErrorf returns an error diagnostic at the given position in the
+// configuration. The filename is filled in later by the caller that knows
+// which file the AST came from.
+func diagErrorf(pos token.Pos, format string, args ...interface{}) *Diagnostic {
+	return &Diagnostic{
+		Severity: DiagnosticError,
+		Message:  fmt.Sprintf(format, args...),
+		Filename: pos.Filename,
+		Line:     pos.Line,
+		Column:   pos.Column,
+	}
+}
@@ -0,0 +1,282 @@
+package padstone
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// A journal is a record of each change made to a resource, written as the
+// change happens. Terraform reports a new state only after each resource
+// is complete, so if the process is killed while a resource is being
+// created the resulting state may not mention it, while the journal will
+// at least record that its creation began.
+//
+// The journal is a sequence of JSON objects, one per line, each of which is
+// a JournalEntry. Each change produces a "start" entry before the provider
+// is called and a "finish" entry afterwards.
+
+// JournalEntry is a single entry in a journal.
+type JournalEntry struct {
+	Time time.Time `json:"time"`
+
+	// Phase is either "start" or "finish".
+	Phase string `json:"phase"`
+
+	// Action is either "create" or "destroy". Updates are recorded as
+	// creates, since either way the result is a resource that exists.
+	Action string `json:"action"`
+
+	Target string `json:"target"`
+
+	// ModulePath is the path of the module containing the resource within
+	// its target's configuration, starting with "root".
+	ModulePath []string `json:"module_path"`
+
+	// Key is the resource's key within its module's state, such as
+	// "aws_instance.foo" or "aws_instance.foo.0".
+	Key  string `json:"key"`
+	Type string `json:"type"`
+
+	// ID and Attributes are recorded on finish entries for resources that
+	// exist after the change.
+	ID         string            `json:"id,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	// Error is recorded on finish entries for changes that failed.
+	Error string `json:"error,omitempty"`
+}
+
+func (e *JournalEntry) String() string {
+	return fmt.Sprintf("%s %s", e.Action, e.address())
+}
+
+// address returns the address of the entry's resource in the form used by
+// StateResource, prefixed by its target name.
+func (e *JournalEntry) address() string {
+	var prefix string
+	for _, name := range e.ModulePath[1:] {
+		prefix += "module." + name + "."
+	}
+	return fmt.Sprintf("%s: %s%s", e.Target, prefix, e.Key)
+}
+
+// JournalHook is a TargetHook that writes a journal of changes to
+// resources.
+//
+// If the writer has a Sync method, as *os.File does, it is called after
+// each entry is written so that the entry is on disk before the change
+// proceeds. If an entry cannot be written, the change is halted.
+type JournalHook struct {
+	terraform.NilHook
+
+	w    io.Writer
+	lock sync.Mutex
+}
+
+// NewJournalHook creates a JournalHook that writes to the given writer.
+func NewJournalHook(w io.Writer) *JournalHook {
+	return &JournalHook{w: w}
+}
+
+// ForTarget returns a hook that records the changes made for the target
+// with the given name.
+func (h *JournalHook) ForTarget(name string) terraform.Hook {
+	return &targetJournalHook{
+		journal: h,
+		target:  name,
+	}
+}
+
+func (h *JournalHook) write(entry *JournalEntry) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+
+	if _, err := h.w.Write(buf); err != nil {
+		return fmt.Errorf("error writing journal: %s", err)
+	}
+
+	if syncer, ok := h.w.(interface {
+		Sync() error
+	}); ok {
+		if err := syncer.Sync(); err != nil {
+			return fmt.Errorf("error writing journal: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// targetJournalHook is the hook returned by JournalHook.ForTarget.
+type targetJournalHook struct {
+	terraform.NilHook
+
+	journal *JournalHook
+	target  string
+
+	lock    sync.Mutex
+	actions map[string]string
+}
+
+func (h *targetJournalHook) PreApply(info *terraform.InstanceInfo, s *terraform.InstanceState, d *terraform.InstanceDiff) (terraform.HookAction, error) {
+	action := "create"
+	if d.Destroy {
+		action = "destroy"
+	}
+
+	h.lock.Lock()
+	if h.actions == nil {
+		h.actions = make(map[string]string)
+	}
+	h.actions[h.key(info)] = action
+	h.lock.Unlock()
+
+	err := h.journal.write(h.entry("start", action, info))
+	if err != nil {
+		return terraform.HookActionHalt, err
+	}
+	return terraform.HookActionContinue, nil
+}
+
+func (h *targetJournalHook) PostApply(info *terraform.InstanceInfo, s *terraform.InstanceState, applyErr error) (terraform.HookAction, error) {
+	h.lock.Lock()
+	action := h.actions[h.key(info)]
+	delete(h.actions, h.key(info))
+	h.lock.Unlock()
+
+	entry := h.entry("finish", action, info)
+	if s != nil && s.ID != "" {
+		entry.ID = s.ID
+		entry.Attributes = s.Attributes
+	}
+	if applyErr != nil {
+		entry.Error = applyErr.Error()
+	}
+
+	err := h.journal.write(entry)
+	if err != nil {
+		return terraform.HookActionHalt, err
+	}
+	return terraform.HookActionContinue, nil
+}
+
+func (h *targetJournalHook) entry(phase, action string, info *terraform.InstanceInfo) *JournalEntry {
+	return &JournalEntry{
+		Time:       time.Now().UTC(),
+		Phase:      phase,
+		Action:     action,
+		Target:     h.target,
+		ModulePath: info.ModulePath,
+		Key:        info.Id,
+		Type:       info.Type,
+	}
+}
+
+func (h *targetJournalHook) key(info *terraform.InstanceInfo) string {
+	return fmt.Sprintf("%v %s", info.ModulePath, info.Id)
+}
+
+// ReadJournal reads the entries of a journal written by JournalHook.
+//
+// The last line of the journal is ignored if it is incomplete, since the
+// process writing it may have been killed part-way through.
+func ReadJournal(r io.Reader) ([]*JournalEntry, error) {
+	var ret []*JournalEntry
+
+	br := bufio.NewReader(r)
+	for lineNum := 1; ; lineNum++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// Either the journal ended cleanly, or the last entry was
+			// never finished.
+			return ret, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading journal: %s", err)
+		}
+
+		entry := &JournalEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			return nil, fmt.Errorf("error reading journal line %d: %s", lineNum, err)
+		}
+		if len(entry.ModulePath) == 0 {
+			return nil, fmt.Errorf("error reading journal line %d: entry has no module path", lineNum)
+		}
+		ret = append(ret, entry)
+	}
+}
+
+// RecoverState applies the changes recorded in the given journal entries
+// to the given result state, which is modified in-place, so that it
+// records all of the resources that the journal shows to exist.
+//
+// It returns the start entries of any changes that never finished. The
+// fate of those resources is unknown, so they must be checked by hand.
+func RecoverState(state *terraform.State, entries []*JournalEntry) []*JournalEntry {
+	var unfinished []*JournalEntry
+	started := make(map[string]int)
+
+	for _, entry := range entries {
+		key := entry.address()
+
+		if entry.Phase == "start" {
+			started[key] = len(unfinished)
+			unfinished = append(unfinished, entry)
+			continue
+		}
+
+		if i, ok := started[key]; ok {
+			unfinished[i] = nil
+			delete(started, key)
+		}
+
+		path := append([]string{"root", entry.Target}, entry.ModulePath[1:]...)
+		mod := state.ModuleByPath(path)
+
+		if entry.ID == "" {
+			// The resource does not exist after this change, either
+			// because it was destroyed or because it failed to create.
+			if mod != nil {
+				delete(mod.Resources, entry.Key)
+			}
+			continue
+		}
+
+		if mod == nil {
+			mod = state.AddModule(path)
+		}
+		rs := mod.Resources[entry.Key]
+		if rs == nil {
+			rs = &terraform.ResourceState{
+				Type: entry.Type,
+			}
+			mod.Resources[entry.Key] = rs
+		}
+		rs.Primary = &terraform.InstanceState{
+			ID:         entry.ID,
+			Attributes: entry.Attributes,
+			// A failed change may have left the resource in an
+			// unknown condition, so it must be replaced.
+			Tainted: entry.Error != "",
+		}
+	}
+
+	var ret []*JournalEntry
+	for _, entry := range unfinished {
+		if entry != nil {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
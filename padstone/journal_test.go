@@ -0,0 +1,111 @@
+package padstone
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestJournalRecoverState(t *testing.T) {
+	config, err := ParseConfig([]byte(contextTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	var journal bytes.Buffer
+	ctx := &Context{
+		Config:  config,
+		Targets: config.DefaultBuildTargets,
+		State:   terraform.NewState(),
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(testProvider()),
+		},
+		Hooks: []terraform.Hook{NewJournalHook(&journal)},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+
+	err = ctx.Build()
+	if err != nil {
+		t.Fatalf("unexpected error building: %s", err)
+	}
+	built := journal.Len()
+
+	err = ctx.CleanUp()
+	if err != nil {
+		t.Fatalf("unexpected error cleaning up: %s", err)
+	}
+
+	// Recovering from the journal as it was after the build gives the
+	// resources that the build created.
+	entries, err := ReadJournal(bytes.NewReader(journal.Bytes()[:built]))
+	if err != nil {
+		t.Fatalf("unexpected error reading journal: %s", err)
+	}
+	state := terraform.NewState()
+	if unfinished := RecoverState(state, entries); len(unfinished) != 0 {
+		t.Fatalf("got unfinished changes %s; want none", unfinished)
+	}
+	want := []StateResource{
+		{"image", "test_image.result", "test_image.result"},
+		{"instance", "test_instance.source", "test_instance.source"},
+	}
+	if got := StateResources(state); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after build recovered %#v; want %#v", got, want)
+	}
+	image := state.ModuleByPath([]string{"root", "image"}).Resources["test_image.result"]
+	if got, want := image.Primary.Attributes["instance_id"], "test_instance.source"; got != want {
+		t.Fatalf("recovered image has instance_id %q; want %q", got, want)
+	}
+
+	// Recovering from the whole journal shows the temporary instance was
+	// destroyed.
+	entries, err = ReadJournal(bytes.NewReader(journal.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error reading journal: %s", err)
+	}
+	state = terraform.NewState()
+	RecoverState(state, entries)
+	want = []StateResource{
+		{"image", "test_image.result", "test_image.result"},
+	}
+	if got := StateResources(state); !reflect.DeepEqual(got, want) {
+		t.Fatalf("after clean up recovered %#v; want %#v", got, want)
+	}
+}
+
+func TestJournalRecoverStateUnfinished(t *testing.T) {
+	journal := strings.Join([]string{
+		`{"phase":"start","action":"create","target":"instance","module_path":["root"],"key":"test_instance.source","type":"test_instance"}`,
+		`{"phase":"finish","action":"create","target":"instance","module_path":["root"],"key":"test_instance.source","type":"test_instance","id":"i-123"}`,
+		`{"phase":"start","action":"create","target":"image","module_path":["root"],"key":"test_image.result","type":"test_image"}`,
+		// The process was killed while writing this entry.
+		`{"phase":"fin`,
+	}, "\n")
+
+	entries, err := ReadJournal(strings.NewReader(journal))
+	if err != nil {
+		t.Fatalf("unexpected error reading journal: %s", err)
+	}
+
+	state := terraform.NewState()
+	unfinished := RecoverState(state, entries)
+	if got, want := len(unfinished), 1; got != want {
+		t.Fatalf("got %d unfinished changes; want %d", got, want)
+	}
+	if got, want := unfinished[0].String(), "create image: test_image.result"; got != want {
+		t.Fatalf("got unfinished change %q; want %q", got, want)
+	}
+
+	want := []StateResource{
+		{"instance", "test_instance.source", "i-123"},
+	}
+	if got := StateResources(state); !reflect.DeepEqual(got, want) {
+		t.Fatalf("recovered %#v; want %#v", got, want)
+	}
+}
@@ -0,0 +1,148 @@
+package padstone
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// BuildMetadata is information about a build that is recorded in its
+// result state, alongside the resources of its targets.
+type BuildMetadata struct {
+	// BuildID uniquely identifies the build. A build that is resumed keeps
+	// its original ID.
+	BuildID string `json:"build_id,omitempty"`
+
+	// PadstoneVersion is the version of Padstone that made the build.
+	PadstoneVersion string `json:"padstone_version,omitempty"`
+
+	// StartedAt is the time the build first started, and FinishedAt is the
+	// time it completed. FinishedAt is the zero time if the build has not
+	// completed successfully.
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+
+	// Targets is the names of the targets that were kept, and
+	// TemporaryTargets the names of those that were built only to be
+	// destroyed once the build was complete, each in build order.
+	Targets          []string `json:"targets,omitempty"`
+	TemporaryTargets []string `json:"temporary_targets,omitempty"`
+
+	// Variables is the values of the configuration's variables, other than
+	// any whose names suggest they are secret.
+	Variables map[string]interface{} `json:"variables,omitempty"`
+
+	// User and Host identify who made the build, and where.
+	User string `json:"user,omitempty"`
+	Host string `json:"host,omitempty"`
+
+	// Labels are arbitrary key/value pairs given when the build was made,
+	// for use in finding it later.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// ConfigPath is the absolute path of the configuration file or
+	// directory that the build was made from.
+	ConfigPath string `json:"config_path,omitempty"`
+
+	// ConfigHash is a hash of the configuration files, as returned by
+	// ConfigHash, so that it can be told whether the configuration at
+	// ConfigPath has changed since the build.
+	ConfigHash string `json:"config_hash,omitempty"`
+
+	// Snapshot records the provider configuration of each target as it was
+	// built, so that the build can be destroyed without the configuration.
+	Snapshot *ConfigSnapshot `json:"snapshot,omitempty"`
+
+	// ExpiresAt is the time after which the build's resources may be
+	// destroyed by garbage collection. It is the zero time if the build
+	// never expires.
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// Published is set once the build's state has been published, and
+	// Protected is set for builds that are to be kept regardless of their
+	// expiry time. Garbage collection never destroys a published or
+	// protected build.
+	Published bool `json:"published,omitempty"`
+	Protected bool `json:"protected,omitempty"`
+}
+
+// Expired returns true if the build has an expiry time that is not after
+// the given time.
+func (m *BuildMetadata) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !m.ExpiresAt.After(now)
+}
+
+// NewBuildID returns a new random build ID.
+func NewBuildID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("error generating build ID: %s", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// The metadata is recorded as the attributes of a pseudo-resource in the
+// root module of the result state, which otherwise has no resources of its
+// own. Terraform never sees the root module, since each target is given
+// only its own portion of the state.
+const (
+	metadataResourceKey  = "padstone_build.metadata"
+	metadataResourceType = "padstone_build"
+	metadataAttribute    = "json"
+)
+
+// StateMetadata returns the build metadata recorded in the given result
+// state. If the state has no metadata, the result is empty metadata.
+func StateMetadata(state *terraform.State) (*BuildMetadata, error) {
+	ret := &BuildMetadata{}
+
+	root := state.ModuleByPath(rootModulePath)
+	if root == nil {
+		return ret, nil
+	}
+	rs := root.Resources[metadataResourceKey]
+	if rs == nil || rs.Primary == nil {
+		return ret, nil
+	}
+
+	err := json.Unmarshal([]byte(rs.Primary.Attributes[metadataAttribute]), ret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid build metadata: %s", err)
+	}
+	return ret, nil
+}
+
+// SetStateMetadata records the given build metadata in the given result
+// state, replacing any that was already present.
+func SetStateMetadata(state *terraform.State, meta *BuildMetadata) error {
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	root := state.ModuleByPath(rootModulePath)
+	if root == nil {
+		root = state.AddModule(rootModulePath)
+	}
+	root.Resources[metadataResourceKey] = &terraform.ResourceState{
+		Type: metadataResourceType,
+		Primary: &terraform.InstanceState{
+			ID: "metadata",
+			Attributes: map[string]string{
+				metadataAttribute: string(buf),
+			},
+		},
+	}
+	return nil
+}
+
+// StateHasResources returns true if any of the targets in the given result
+// state has resources. Unlike terraform.State.HasResources, it disregards
+// the build metadata.
+func StateHasResources(state *terraform.State) bool {
+	return len(StateResources(state)) > 0
+}
@@ -0,0 +1,139 @@
+package padstone
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestStateMetadata(t *testing.T) {
+	state := terraform.NewState()
+
+	meta, err := StateMetadata(state)
+	if err != nil {
+		t.Fatalf("unexpected error reading metadata: %s", err)
+	}
+	if !meta.ExpiresAt.IsZero() || meta.Published || meta.Protected {
+		t.Fatalf("state with no metadata has %#v; want empty metadata", meta)
+	}
+
+	expires := time.Date(2016, 10, 1, 12, 0, 0, 0, time.UTC)
+	err = SetStateMetadata(state, &BuildMetadata{
+		ConfigPath: "/builds/ami",
+		ExpiresAt:  expires,
+		Protected:  true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error setting metadata: %s", err)
+	}
+
+	// Metadata must survive a round-trip through Terraform's state format,
+	// and doesn't count as a resource of the build.
+	var buf bytes.Buffer
+	if err := terraform.WriteState(state, &buf); err != nil {
+		t.Fatalf("unexpected error writing state: %s", err)
+	}
+	state, err = terraform.ReadState(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error reading state: %s", err)
+	}
+	if StateHasResources(state) {
+		t.Fatalf("state with only metadata has resources")
+	}
+
+	meta, err = StateMetadata(state)
+	if err != nil {
+		t.Fatalf("unexpected error reading metadata: %s", err)
+	}
+	if got, want := meta.ConfigPath, "/builds/ami"; got != want {
+		t.Fatalf("got config path %q; want %q", got, want)
+	}
+	if got, want := meta.ExpiresAt, expires; !got.Equal(want) {
+		t.Fatalf("got expiry time %s; want %s", got, want)
+	}
+	if !meta.Protected {
+		t.Fatalf("build is not protected; should be")
+	}
+
+	if meta.Expired(expires.Add(-time.Second)) {
+		t.Fatalf("build expired before its expiry time")
+	}
+	if !meta.Expired(expires) {
+		t.Fatalf("build did not expire at its expiry time")
+	}
+	if (&BuildMetadata{}).Expired(expires) {
+		t.Fatalf("build with no expiry time expired")
+	}
+}
+
+func TestContextBuildMetadata(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+variable "version" {
+  default = "dev"
+}
+
+variable "api_password" {}
+`+contextTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	state := terraform.NewState()
+	err = SetStateMetadata(state, &BuildMetadata{
+		Labels: map[string]string{"env": "staging"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error setting metadata: %s", err)
+	}
+
+	before := time.Now()
+	ctx := &Context{
+		Config:  config,
+		Targets: config.DefaultBuildTargets,
+		State:   state,
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(testProvider()),
+		},
+		Variables: map[string]string{
+			"api_password": "hunter2",
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+
+	err = ctx.Build()
+	if err != nil {
+		t.Fatalf("unexpected error building: %s", err)
+	}
+
+	meta, err := StateMetadata(ctx.ResultState)
+	if err != nil {
+		t.Fatalf("unexpected error reading metadata: %s", err)
+	}
+	if meta.BuildID == "" {
+		t.Fatalf("no build ID recorded")
+	}
+	if got, want := meta.PadstoneVersion, Version; got != want {
+		t.Fatalf("got version %q; want %q", got, want)
+	}
+	if meta.StartedAt.Before(before.Truncate(time.Second)) || meta.FinishedAt.Before(meta.StartedAt) {
+		t.Fatalf("got start time %s and finish time %s; want both after %s", meta.StartedAt, meta.FinishedAt, before)
+	}
+	if got, want := meta.Targets, []string{"image"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got targets %#v; want %#v", got, want)
+	}
+	if got, want := meta.TemporaryTargets, []string{"instance"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got temporary targets %#v; want %#v", got, want)
+	}
+	if got, want := meta.Variables, map[string]interface{}{"version": "dev"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got variables %#v; want %#v", got, want)
+	}
+	if got, want := meta.Labels, map[string]string{"env": "staging"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got labels %#v; want %#v", got, want)
+	}
+}
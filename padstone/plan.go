@@ -0,0 +1,308 @@
+package padstone
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	tfcfg "github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// Plan is the result of planning a build: the Terraform plan for each of
+// the targets that would be built, along with the target selection and
+// variables that were used to produce them.
+//
+// A plan can be saved with WritePlan and later executed by setting it as
+// the SavedPlan of a Context and calling Build.
+type Plan struct {
+	// Targets is the names of the targets that are to be kept once the
+	// build is complete, as for Context.Targets.
+	Targets []string
+
+	Variables map[string]string
+
+	// TargetPlans is the Terraform plan for each target that would be
+	// built, keyed by target name.
+	//
+	// A target that depends on the outputs of other targets is planned
+	// with unknown values for those outputs, since they are not known
+	// until the other targets have been built.
+	TargetPlans map[string]*terraform.Plan
+}
+
+// ResourceChange describes a change that a plan would make to a single
+// resource.
+type ResourceChange struct {
+	// Address is the address of the resource within its target's
+	// configuration, such as "aws_instance.foo" or
+	// "module.network.aws_subnet.main".
+	Address string
+
+	Change terraform.DiffChangeType
+}
+
+func (c ResourceChange) String() string {
+	return fmt.Sprintf("%s %s", changeSymbol(c.Change), c.Address)
+}
+
+// ResourceChanges returns the changes that the plan would make to the
+// resources of the target with the given name, sorted by address.
+func (p *Plan) ResourceChanges(targetName string) []ResourceChange {
+	plan := p.TargetPlans[targetName]
+	if plan == nil {
+		return nil
+	}
+	return diffResourceChanges(plan.Diff)
+}
+
+// hasUnknowns returns true if the given target's plan was made with any
+// unknown variable values, in which case it must be planned again once the
+// values are known.
+func (p *Plan) hasUnknowns(targetName string) bool {
+	plan := p.TargetPlans[targetName]
+	if plan == nil {
+		return false
+	}
+	for _, v := range plan.Vars {
+		if v == tfcfg.UnknownVariableValue {
+			return true
+		}
+	}
+	return false
+}
+
+// Plan determines what Build would do for the selected targets and their
+// dependencies, without creating anything.
+//
+// Each target is planned in dependency order. Outputs of other targets
+// that are present in State are used as-is, while any others are unknown.
+func (c *Context) Plan() (*Plan, error) {
+	if err := c.prepare(); err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		Targets:     c.selection.Kept,
+		Variables:   c.Variables,
+		TargetPlans: make(map[string]*terraform.Plan, len(c.selection.Order)),
+	}
+
+	for _, name := range c.selection.Order {
+		tfctx, err := c.terraformContext(name, opPlan)
+		if err != nil {
+			return nil, fmt.Errorf("error planning target %s: %s", name, err)
+		}
+
+		if err := c.input(tfctx); err != nil {
+			return nil, fmt.Errorf("error planning target %s: %s", name, err)
+		}
+
+		targetPlan, err := tfctx.Plan()
+		if err != nil {
+			return nil, fmt.Errorf("error planning target %s: %s", name, err)
+		}
+		plan.TargetPlans[name] = targetPlan
+	}
+
+	return plan, nil
+}
+
+// planTarget creates a Terraform context for building the target with the
+// given name from SavedPlan.
+//
+// A target planned with only known values has its saved plan applied
+// exactly. A target planned with unknown values, because it depends on
+// other targets, is planned again now that those are known, and the new
+// plan must make the same changes to the same resources as the saved one.
+func (c *Context) planTarget(name string) (*terraform.Context, error) {
+	saved := c.SavedPlan.TargetPlans[name]
+
+	if !c.SavedPlan.hasUnknowns(name) {
+		return saved.Context(&terraform.ContextOpts{
+			Hooks:        c.targetHooks(name, false),
+			Providers:    c.Providers,
+			Provisioners: c.Provisioners,
+		})
+	}
+
+	tfctx, err := c.terraformContext(name, opApply)
+	if err != nil {
+		return nil, err
+	}
+
+	plan, err := tfctx.Plan()
+	if err != nil {
+		return nil, err
+	}
+
+	got := diffResourceChanges(plan.Diff)
+	want := diffResourceChanges(saved.Diff)
+	if !sameResourceChanges(got, want) {
+		return nil, fmt.Errorf(
+			"changes no longer match the saved plan\nsaved plan:\n%s\nnew plan:\n%s",
+			formatResourceChanges(want), formatResourceChanges(got),
+		)
+	}
+
+	return tfctx, nil
+}
+
+// WritePlan writes the given plan to the given writer in a form that can
+// be read back by ReadPlan.
+func WritePlan(p *Plan, w io.Writer) error {
+	file := &planFile{
+		Targets:     p.Targets,
+		Variables:   p.Variables,
+		TargetPlans: make(map[string][]byte, len(p.TargetPlans)),
+	}
+
+	for name, plan := range p.TargetPlans {
+		var buf bytes.Buffer
+		if err := terraform.WritePlan(plan, &buf); err != nil {
+			return fmt.Errorf("error writing plan for target %s: %s", name, err)
+		}
+		file.TargetPlans[name] = buf.Bytes()
+	}
+
+	if _, err := io.WriteString(w, planFileMagic); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{planFileVersion}); err != nil {
+		return err
+	}
+
+	return gob.NewEncoder(w).Encode(file)
+}
+
+// ReadPlan reads a plan written by WritePlan.
+func ReadPlan(r io.Reader) (*Plan, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(planFileMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("error reading plan: %s", err)
+	}
+	if string(header[:len(planFileMagic)]) != planFileMagic {
+		return nil, fmt.Errorf("not a padstone plan file")
+	}
+	if v := header[len(planFileMagic)]; v != planFileVersion {
+		return nil, fmt.Errorf("unsupported plan file version %d", v)
+	}
+
+	var file planFile
+	if err := gob.NewDecoder(br).Decode(&file); err != nil {
+		return nil, fmt.Errorf("error reading plan: %s", err)
+	}
+
+	p := &Plan{
+		Targets:     file.Targets,
+		Variables:   file.Variables,
+		TargetPlans: make(map[string]*terraform.Plan, len(file.TargetPlans)),
+	}
+
+	for name, raw := range file.TargetPlans {
+		plan, err := terraform.ReadPlan(bytes.NewReader(raw))
+		if err != nil {
+			return nil, fmt.Errorf("error reading plan for target %s: %s", name, err)
+		}
+		p.TargetPlans[name] = plan
+	}
+
+	return p, nil
+}
+
+const planFileMagic = "padstoneplan"
+const planFileVersion byte = 1
+
+// planFile is the structure that is encoded into a plan file. Each target's
+// plan is stored in Terraform's own plan format.
+type planFile struct {
+	Targets     []string
+	Variables   map[string]string
+	TargetPlans map[string][]byte
+}
+
+func diffResourceChanges(diff *terraform.Diff) []ResourceChange {
+	var ret []ResourceChange
+	if diff == nil {
+		return ret
+	}
+
+	for _, mod := range diff.Modules {
+		var prefix string
+		for _, name := range mod.Path[1:] {
+			prefix += "module." + name + "."
+		}
+
+		for key, instance := range mod.Resources {
+			change := instance.ChangeType()
+			if change == terraform.DiffNone {
+				continue
+			}
+			ret = append(ret, ResourceChange{
+				Address: prefix + key,
+				Change:  change,
+			})
+		}
+	}
+
+	sort.Sort(resourceChanges(ret))
+	return ret
+}
+
+func sameResourceChanges(a, b []ResourceChange) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatResourceChanges(changes []ResourceChange) string {
+	if len(changes) == 0 {
+		return "  (no changes)"
+	}
+	lines := make([]string, len(changes))
+	for i, change := range changes {
+		lines[i] = "  " + change.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func changeSymbol(change terraform.DiffChangeType) string {
+	switch change {
+	case terraform.DiffCreate:
+		return "+"
+	case terraform.DiffUpdate:
+		return "~"
+	case terraform.DiffDestroy:
+		return "-"
+	case terraform.DiffDestroyCreate:
+		return "-/+"
+	default:
+		return "?"
+	}
+}
+
+type resourceChanges []ResourceChange
+
+func (s resourceChanges) Len() int {
+	return len(s)
+}
+
+func (s resourceChanges) Less(i, j int) bool {
+	return s[i].Address < s[j].Address
+}
+
+func (s resourceChanges) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
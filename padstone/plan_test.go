@@ -0,0 +1,99 @@
+package padstone
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestContextPlan(t *testing.T) {
+	config, err := ParseConfig([]byte(contextTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	provider := testProvider()
+	ctx := &Context{
+		Config:  config,
+		Targets: config.DefaultBuildTargets,
+		State:   terraform.NewState(),
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+
+	plan, err := ctx.Plan()
+	if err != nil {
+		t.Fatalf("unexpected error planning: %s", err)
+	}
+
+	if got, want := plan.Targets, []string{"image"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got targets %#v; want %#v", got, want)
+	}
+	if got, want := plan.ResourceChanges("instance"), []ResourceChange{{"test_instance.source", terraform.DiffCreate}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got instance changes %#v; want %#v", got, want)
+	}
+	if got, want := plan.ResourceChanges("image"), []ResourceChange{{"test_image.result", terraform.DiffCreate}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got image changes %#v; want %#v", got, want)
+	}
+	if plan.hasUnknowns("instance") {
+		t.Fatalf("instance plan has unknowns; should not")
+	}
+	if !plan.hasUnknowns("image") {
+		t.Fatalf("image plan has no unknowns; should have")
+	}
+
+	// Planning must not create anything.
+	if got := StateTargetNames(ctx.State); len(got) != 0 {
+		t.Fatalf("after plan got targets %#v; want none", got)
+	}
+
+	var buf bytes.Buffer
+	if err := WritePlan(plan, &buf); err != nil {
+		t.Fatalf("unexpected error writing plan: %s", err)
+	}
+	saved, err := ReadPlan(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error reading plan: %s", err)
+	}
+	if got, want := saved.ResourceChanges("image"), plan.ResourceChanges("image"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got saved image changes %#v; want %#v", got, want)
+	}
+
+	buildCtx := &Context{
+		Config:    config,
+		Targets:   saved.Targets,
+		Variables: saved.Variables,
+		State:     terraform.NewState(),
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+		SavedPlan: saved,
+	}
+
+	err = buildCtx.Build()
+	if err != nil {
+		t.Fatalf("unexpected error building from plan: %s", err)
+	}
+
+	image := buildCtx.ResultState.ModuleByPath([]string{"root", "image"}).Resources["test_image.result"]
+	if got, want := image.Primary.Attributes["instance_id"], "test_instance.source"; got != want {
+		t.Fatalf("image was built from %q; want %q", got, want)
+	}
+}
+
+func TestReadPlanInvalid(t *testing.T) {
+	_, err := ReadPlan(bytes.NewReader([]byte("not a plan at all")))
+	if err == nil {
+		t.Fatalf("succeeded; want error")
+	}
+}
@@ -0,0 +1,344 @@
+package padstone
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hil"
+	"github.com/hashicorp/hil/ast"
+	tfcfg "github.com/hashicorp/terraform/config"
+	tfmod "github.com/hashicorp/terraform/config/module"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// ConfigSnapshot is the part of a build's configuration that is needed to
+// destroy it, recorded in its metadata so that it can be destroyed without
+// the original configuration.
+//
+// Destroying a target needs only the configuration of its providers, so
+// that is all that is recorded, with any interpolations resolved to the
+// values they had when the target was built.
+type ConfigSnapshot struct {
+	// Targets is a snapshot of each of the targets that was built, in the
+	// order they were built.
+	Targets []*TargetSnapshot `json:"targets"`
+}
+
+// TargetSnapshot is the recorded configuration of a single target.
+type TargetSnapshot struct {
+	Name      string              `json:"name"`
+	Providers []*ProviderSnapshot `json:"providers"`
+
+	// Incomplete is set if some of the target's provider configuration
+	// could not be resolved when it was built, in which case the snapshot
+	// cannot be used to destroy it.
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// ProviderSnapshot is the recorded configuration of a single provider.
+type ProviderSnapshot struct {
+	Name   string                 `json:"name"`
+	Alias  string                 `json:"alias,omitempty"`
+	Config map[string]interface{} `json:"config"`
+
+	// Omitted is the names of the settings that were left out of Config
+	// because they look like they may be secret. Providers usually take
+	// these from the environment, and otherwise prompt for them.
+	Omitted []string `json:"omitted,omitempty"`
+}
+
+// Target returns the snapshot of the target with the given name, or nil if
+// it was not recorded.
+func (s *ConfigSnapshot) Target(name string) *TargetSnapshot {
+	for _, target := range s.Targets {
+		if target.Name == name {
+			return target
+		}
+	}
+	return nil
+}
+
+// Config returns a configuration built from the snapshot that is suitable
+// for destroying the targets with the given names, or an error explaining
+// why the snapshot is not sufficient to do so.
+//
+// The provider settings that were omitted from the snapshot are filled in
+// from the given settings, as described for ProviderSnapshot.Setting. Any
+// that are not given are left for the provider to take from the
+// environment or to prompt for.
+//
+// The targets in the result have no resources, so that Destroy will treat
+// all of the resources in the state as orphans and destroy them. They are
+// declared in the order they were built, which is therefore also the order
+// of their target graph.
+func (s *ConfigSnapshot) Config(targetNames []string, settings map[string]string) (*Config, error) {
+	for _, name := range targetNames {
+		target := s.Target(name)
+		if target == nil {
+			return nil, fmt.Errorf("the configuration of target %s was not recorded", name)
+		}
+		if target.Incomplete {
+			return nil, fmt.Errorf("the provider configuration of target %s could not be fully recorded", name)
+		}
+	}
+
+	ret := &Config{}
+	for _, target := range s.Targets {
+		targetConfig := &TargetConfig{
+			Name: target.Name,
+		}
+		for _, provider := range target.Providers {
+			config := provider.Config
+			for _, name := range provider.Omitted {
+				if value, ok := provider.Setting(settings, name); ok {
+					config = withSetting(config, strings.Split(name, "."), value)
+				}
+			}
+
+			rawConfig, err := tfcfg.NewRawConfig(config)
+			if err != nil {
+				return nil, fmt.Errorf("target %s provider %s: %s", target.Name, provider.Name, err)
+			}
+			targetConfig.Providers = append(targetConfig.Providers, &tfcfg.ProviderConfig{
+				Name:      provider.Name,
+				Alias:     provider.Alias,
+				RawConfig: rawConfig,
+			})
+		}
+		ret.Targets = append(ret.Targets, targetConfig)
+	}
+
+	return ret, nil
+}
+
+// FullName returns the name of the provider qualified by its alias, if it
+// has one, as used to refer to it in resource configuration.
+func (p *ProviderSnapshot) FullName() string {
+	if p.Alias == "" {
+		return p.Name
+	}
+	return p.Name + "." + p.Alias
+}
+
+// Setting returns the value in the given settings for the omitted setting
+// with the given name, and whether there is one. The value may be given
+// either under the name of the setting alone, such as "access_key", or
+// qualified by the provider's full name, such as "aws.use1.access_key",
+// which takes precedence.
+func (p *ProviderSnapshot) Setting(settings map[string]string, name string) (string, bool) {
+	if value, ok := settings[p.FullName()+"."+name]; ok {
+		return value, true
+	}
+	value, ok := settings[name]
+	return value, ok
+}
+
+// withSetting returns a copy of the given provider configuration with the
+// setting at the given path set to value, leaving the original unchanged.
+// Settings inside repeated blocks cannot be addressed by a path, so the
+// configuration is returned as-is if the path leads into one.
+func withSetting(config map[string]interface{}, path []string, value string) map[string]interface{} {
+	ret := make(map[string]interface{}, len(config)+1)
+	for k, v := range config {
+		ret[k] = v
+	}
+
+	if len(path) == 1 {
+		ret[path[0]] = value
+		return ret
+	}
+
+	switch nested := config[path[0]].(type) {
+	case nil:
+		ret[path[0]] = withSetting(nil, path[1:], value)
+	case map[string]interface{}:
+		ret[path[0]] = withSetting(nested, path[1:], value)
+	default:
+		return config
+	}
+	return ret
+}
+
+// setTarget records the given target snapshot, replacing any existing one
+// for the same target, and keeping the targets in the given build order.
+func (s *ConfigSnapshot) setTarget(snapshot *TargetSnapshot, order []string) {
+	byName := make(map[string]*TargetSnapshot, len(s.Targets)+1)
+	for _, target := range s.Targets {
+		byName[target.Name] = target
+	}
+	byName[snapshot.Name] = snapshot
+
+	s.Targets = s.Targets[:0]
+	for _, name := range order {
+		if target := byName[name]; target != nil {
+			s.Targets = append(s.Targets, target)
+			delete(byName, name)
+		}
+	}
+
+	// Targets that are no longer selected, such as those from an earlier
+	// build being resumed, are kept at the end.
+	var rest []string
+	for name := range byName {
+		rest = append(rest, name)
+	}
+	sort.Strings(rest)
+	for _, name := range rest {
+		s.Targets = append(s.Targets, byName[name])
+	}
+}
+
+// snapshotTarget records the provider configuration of the root module of
+// the given Terraform context, which is ready to build the target with the
+// given name.
+func snapshotTarget(name string, tfctx *terraform.Context) *TargetSnapshot {
+	ret := &TargetSnapshot{
+		Name: name,
+	}
+
+	// Resources in child modules use the root module's providers unless
+	// their own modules configure providers, which are not recorded.
+	if childProviders(tfctx.Module()) {
+		ret.Incomplete = true
+	}
+
+	variables := tfctx.Variables()
+
+	for _, provider := range tfctx.Module().Config().ProviderConfigs {
+		rawConfig := provider.RawConfig.Copy()
+
+		vars := make(map[string]ast.Variable)
+		for key, v := range rawConfig.Variables {
+			uv, ok := v.(*tfcfg.UserVariable)
+			if !ok {
+				// Only variables are known before the target is built.
+				ret.Incomplete = true
+				continue
+			}
+			value, ok := variables[uv.Name]
+			if !ok {
+				ret.Incomplete = true
+				continue
+			}
+			hilVar, err := hil.InterfaceToVariable(value)
+			if err != nil {
+				ret.Incomplete = true
+				continue
+			}
+			vars[key] = hilVar
+		}
+
+		if err := rawConfig.Interpolate(vars); err != nil {
+			ret.Incomplete = true
+			continue
+		}
+
+		config, omitted := omitSecrets(rawConfig.Config(), "")
+		if containsUnknown(config) {
+			ret.Incomplete = true
+			continue
+		}
+
+		ret.Providers = append(ret.Providers, &ProviderSnapshot{
+			Name:    provider.Name,
+			Alias:   provider.Alias,
+			Config:  config,
+			Omitted: omitted,
+		})
+	}
+
+	return ret
+}
+
+// childProviders returns true if any of the descendents of the given
+// module tree configure providers.
+func childProviders(tree *tfmod.Tree) bool {
+	for _, child := range tree.Children() {
+		if len(child.Config().ProviderConfigs) > 0 || childProviders(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// secretSettingWords are the words that, if they appear in the name of a
+// provider setting or variable, suggest that it is secret.
+var secretSettingWords = []string{
+	"secret", "password", "token", "private", "access_key", "credentials",
+}
+
+// looksSecret returns true if the given setting or variable name suggests
+// that its value is secret.
+func looksSecret(name string) bool {
+	lower := strings.ToLower(name)
+	for _, word := range secretSettingWords {
+		if strings.Contains(lower, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// omitSecrets returns a copy of the given provider configuration with any
+// settings that look secret removed, along with the names of the removed
+// settings.
+func omitSecrets(config map[string]interface{}, prefix string) (map[string]interface{}, []string) {
+	ret := make(map[string]interface{}, len(config))
+	var omitted []string
+
+	for k, v := range config {
+		if looksSecret(k) {
+			omitted = append(omitted, prefix+k)
+			continue
+		}
+
+		switch tv := v.(type) {
+		case map[string]interface{}:
+			var moreOmitted []string
+			ret[k], moreOmitted = omitSecrets(tv, prefix+k+".")
+			omitted = append(omitted, moreOmitted...)
+		case []map[string]interface{}:
+			blocks := make([]map[string]interface{}, len(tv))
+			for i, block := range tv {
+				var moreOmitted []string
+				blocks[i], moreOmitted = omitSecrets(block, prefix+k+".")
+				omitted = append(omitted, moreOmitted...)
+			}
+			ret[k] = blocks
+		default:
+			ret[k] = v
+		}
+	}
+
+	sort.Strings(omitted)
+	return ret, omitted
+}
+
+// containsUnknown returns true if the given value, from an interpolated
+// configuration, contains any unknown values.
+func containsUnknown(v interface{}) bool {
+	switch tv := v.(type) {
+	case string:
+		return strings.Contains(tv, tfcfg.UnknownVariableValue)
+	case map[string]interface{}:
+		for _, ev := range tv {
+			if containsUnknown(ev) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, ev := range tv {
+			if containsUnknown(ev) {
+				return true
+			}
+		}
+	case []map[string]interface{}:
+		for _, ev := range tv {
+			if containsUnknown(ev) {
+				return true
+			}
+		}
+	}
+	return false
+}
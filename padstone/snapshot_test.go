@@ -0,0 +1,203 @@
+package padstone
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	getter "github.com/hashicorp/go-getter"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+const snapshotTestConfig = `
+variable "region" {}
+
+provider "test" {
+  region    = "${var.region}"
+  api_token = "hunter2"
+}
+` + contextTestConfig
+
+func TestSnapshotDestroy(t *testing.T) {
+	config, err := ParseConfig([]byte(snapshotTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	provider := testProvider()
+	ctx := &Context{
+		Config:  config,
+		Targets: []string{"instance", "image"},
+		State:   terraform.NewState(),
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		Variables: map[string]string{
+			"region": "us-west-2",
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+
+	err = ctx.Build()
+	if err != nil {
+		t.Fatalf("unexpected error building: %s", err)
+	}
+
+	// The snapshot must survive being written out as part of the state.
+	buf, err := json.Marshal(ctx.ResultState)
+	if err != nil {
+		t.Fatalf("unexpected error encoding state: %s", err)
+	}
+	state := &terraform.State{}
+	err = json.Unmarshal(buf, state)
+	if err != nil {
+		t.Fatalf("unexpected error decoding state: %s", err)
+	}
+
+	meta, err := StateMetadata(state)
+	if err != nil {
+		t.Fatalf("unexpected error reading metadata: %s", err)
+	}
+	if meta.Snapshot == nil {
+		t.Fatalf("no configuration snapshot recorded")
+	}
+	var names []string
+	for _, target := range meta.Snapshot.Targets {
+		names = append(names, target.Name)
+	}
+	if got, want := names, []string{"instance", "image"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("snapshot has targets %#v; want %#v", got, want)
+	}
+	got := meta.Snapshot.Target("image").Providers[0]
+	want := &ProviderSnapshot{
+		Name: "test",
+		Config: map[string]interface{}{
+			"region": "us-west-2",
+		},
+		Omitted: []string{"api_token"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("image provider snapshot is %#v; want %#v", got, want)
+	}
+
+	// The omitted secret can be given again when destroying.
+	snapshotConfig, err := meta.Snapshot.Config(StateTargetNames(state), map[string]string{
+		"api_token": "hunter3",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error getting snapshot config: %s", err)
+	}
+
+	destroyCtx := &Context{
+		Config:  snapshotConfig,
+		Targets: StateTargetNames(state),
+		State:   state,
+		Providers: map[string]terraform.ResourceProviderFactory{
+			"test": terraform.ResourceProviderFactoryFixed(provider),
+		},
+		ModuleStorage: &getter.FolderStorage{
+			StorageDir: t.TempDir(),
+		},
+	}
+
+	err = destroyCtx.Destroy()
+	if err != nil {
+		t.Fatalf("unexpected error destroying: %s", err)
+	}
+
+	if got, want := provider.destroyed(), []string{"test_image.result", "test_instance.source"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("destroyed %#v; want %#v", got, want)
+	}
+	if got, want := provider.ConfigureConfig.Config["region"], "us-west-2"; got != want {
+		t.Fatalf("provider configured with region %#v; want %#v", got, want)
+	}
+	if got, want := provider.ConfigureConfig.Config["api_token"], "hunter3"; got != want {
+		t.Fatalf("provider configured with api_token %#v; want %#v", got, want)
+	}
+	if StateHasResources(state) {
+		t.Fatalf("state still has resources after destroy")
+	}
+}
+
+func TestSnapshotConfigInsufficient(t *testing.T) {
+	snapshot := &ConfigSnapshot{
+		Targets: []*TargetSnapshot{
+			{Name: "instance"},
+			{Name: "image", Incomplete: true},
+		},
+	}
+
+	if _, err := snapshot.Config([]string{"instance"}, nil); err != nil {
+		t.Fatalf("unexpected error for complete target: %s", err)
+	}
+
+	_, err := snapshot.Config([]string{"instance", "image"}, nil)
+	if got, want := err.Error(), "the provider configuration of target image could not be fully recorded"; got != want {
+		t.Fatalf("got error %q; want %q", got, want)
+	}
+
+	_, err = snapshot.Config([]string{"network"}, nil)
+	if got, want := err.Error(), "the configuration of target network was not recorded"; got != want {
+		t.Fatalf("got error %q; want %q", got, want)
+	}
+}
+
+func TestSnapshotConfigSettings(t *testing.T) {
+	snapshot := &ConfigSnapshot{
+		Targets: []*TargetSnapshot{
+			{
+				Name: "image",
+				Providers: []*ProviderSnapshot{
+					{
+						Name: "aws",
+						Config: map[string]interface{}{
+							"region":      "us-west-2",
+							"assume_role": map[string]interface{}{"role_arn": "arn"},
+						},
+						Omitted: []string{"access_key", "assume_role.session_token"},
+					},
+					{
+						Name:    "aws",
+						Alias:   "use1",
+						Config:  map[string]interface{}{"region": "us-east-1"},
+						Omitted: []string{"access_key"},
+					},
+				},
+			},
+		},
+	}
+
+	config, err := snapshot.Config([]string{"image"}, map[string]string{
+		"access_key":                "AKIA1",
+		"aws.use1.access_key":       "AKIA2",
+		"assume_role.session_token": "token",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	providers := config.Targets[0].Providers
+	if got, want := providers[0].RawConfig.Raw, map[string]interface{}{
+		"region":     "us-west-2",
+		"access_key": "AKIA1",
+		"assume_role": map[string]interface{}{
+			"role_arn":      "arn",
+			"session_token": "token",
+		},
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("aws provider config is %#v; want %#v", got, want)
+	}
+	if got, want := providers[1].RawConfig.Raw, map[string]interface{}{
+		"region":     "us-east-1",
+		"access_key": "AKIA2",
+	}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("aws.use1 provider config is %#v; want %#v", got, want)
+	}
+
+	// The snapshot itself still does not record the secrets.
+	if _, exists := snapshot.Targets[0].Providers[0].Config["access_key"]; exists {
+		t.Fatalf("snapshot was modified")
+	}
+}
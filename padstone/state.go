@@ -0,0 +1,212 @@
+package padstone
+
+import (
+	"sort"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// The result of a build is a single Terraform state covering all of the
+// targets. Each target's root module is recorded at the module path
+// ["root", TARGET], with the target's own child modules nested beneath it,
+// so that the portion belonging to each target can be extracted again
+// when it is time to destroy it.
+//
+// The root module of the result state has no resources of its own, apart
+// from a record of the build's metadata (see BuildMetadata). Its outputs
+// are the outputs of the kept targets, so that the result can be consumed
+// by terraform_remote_state in the same way as any other state.
+
+// TargetState extracts the portion of the given result state that belongs
+// to the target with the given name, as a standalone Terraform state.
+//
+// If the result state has nothing for the given target, the result is an
+// empty state.
+func TargetState(state *terraform.State, targetName string) *terraform.State {
+	ret := state.DeepCopy()
+	mods := ret.Modules
+	ret.Modules = nil
+
+	for _, mod := range mods {
+		if !isTargetModulePath(mod.Path, targetName) {
+			continue
+		}
+
+		mod.Path = append([]string{"root"}, mod.Path[2:]...)
+		ret.Modules = append(ret.Modules, mod)
+	}
+
+	if ret.ModuleByPath(rootModulePath) == nil {
+		ret.AddModule(rootModulePath)
+	}
+
+	return ret
+}
+
+// SetTargetState replaces the portion of the given result state that
+// belongs to the target with the given name with the contents of the given
+// standalone Terraform state.
+func SetTargetState(state *terraform.State, targetName string, targetState *terraform.State) {
+	RemoveTargetState(state, targetName)
+
+	for _, mod := range targetState.DeepCopy().Modules {
+		mod.Path = append([]string{"root", targetName}, mod.Path[1:]...)
+		state.AddModuleState(mod)
+	}
+}
+
+// RemoveTargetState removes the portion of the given result state that
+// belongs to the target with the given name.
+func RemoveTargetState(state *terraform.State, targetName string) {
+	state.Lock()
+	defer state.Unlock()
+
+	mods := state.Modules[:0]
+	for _, mod := range state.Modules {
+		if isTargetModulePath(mod.Path, targetName) {
+			continue
+		}
+		mods = append(mods, mod)
+	}
+	state.Modules = mods
+}
+
+// StateTargetNames returns the names of the targets that have a portion of
+// the given result state.
+func StateTargetNames(state *terraform.State) []string {
+	var ret []string
+	seen := map[string]bool{}
+
+	for _, mod := range state.Modules {
+		if len(mod.Path) != 2 {
+			continue
+		}
+
+		name := mod.Path[1]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		ret = append(ret, name)
+	}
+
+	return ret
+}
+
+// TargetOutputs returns the outputs of each of the targets in the given
+// result state, as a map from target name to a map of output values.
+func TargetOutputs(state *terraform.State) map[string]map[string]interface{} {
+	ret := make(map[string]map[string]interface{})
+
+	for _, mod := range state.Modules {
+		if len(mod.Path) != 2 {
+			continue
+		}
+
+		outputs := make(map[string]interface{}, len(mod.Outputs))
+		for k, output := range mod.Outputs {
+			outputs[k] = output.Value
+		}
+		ret[mod.Path[1]] = outputs
+	}
+
+	return ret
+}
+
+// SetRootOutputs replaces the outputs of the root module of the given
+// result state with the outputs of the targets with the given names.
+//
+// If more than one of the targets has an output of the same name, the
+// target that appears later in the given list takes priority.
+func SetRootOutputs(state *terraform.State, targetNames []string) {
+	root := state.ModuleByPath(rootModulePath)
+	if root == nil {
+		root = state.AddModule(rootModulePath)
+	}
+
+	root.Outputs = make(map[string]*terraform.OutputState)
+	for _, name := range targetNames {
+		mod := state.ModuleByPath([]string{"root", name})
+		if mod == nil {
+			continue
+		}
+
+		for k, output := range mod.Outputs {
+			root.Outputs[k] = &terraform.OutputState{
+				Sensitive: output.Sensitive,
+				Type:      output.Type,
+				Value:     output.Value,
+			}
+		}
+	}
+}
+
+// StateResource describes a single resource recorded in a result state.
+type StateResource struct {
+	// Target is the name of the target that the resource belongs to.
+	Target string
+
+	// Address is the address of the resource within its target's
+	// configuration, such as "aws_instance.foo" or
+	// "module.network.aws_subnet.main".
+	Address string
+
+	// ID is the id of the resource's primary instance, or empty if it has
+	// no primary instance because it was never fully created. A tainted
+	// primary instance still has its id.
+	ID string
+}
+
+// StateResources returns all of the resources recorded in the given result
+// state, sorted by target name and then by address.
+func StateResources(state *terraform.State) []StateResource {
+	var ret []StateResource
+
+	for _, mod := range state.Modules {
+		if len(mod.Path) < 2 || mod.Path[0] != "root" {
+			continue
+		}
+
+		var prefix string
+		for _, name := range mod.Path[2:] {
+			prefix += "module." + name + "."
+		}
+
+		for key, rs := range mod.Resources {
+			res := StateResource{
+				Target:  mod.Path[1],
+				Address: prefix + key,
+			}
+			if rs.Primary != nil {
+				res.ID = rs.Primary.ID
+			}
+			ret = append(ret, res)
+		}
+	}
+
+	sort.Sort(stateResources(ret))
+	return ret
+}
+
+var rootModulePath = []string{"root"}
+
+func isTargetModulePath(path []string, targetName string) bool {
+	return len(path) >= 2 && path[0] == "root" && path[1] == targetName
+}
+
+type stateResources []StateResource
+
+func (s stateResources) Len() int {
+	return len(s)
+}
+
+func (s stateResources) Less(i, j int) bool {
+	if s[i].Target != s[j].Target {
+		return s[i].Target < s[j].Target
+	}
+	return s[i].Address < s[j].Address
+}
+
+func (s stateResources) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
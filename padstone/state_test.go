@@ -0,0 +1,87 @@
+package padstone
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestTargetState(t *testing.T) {
+	state := terraform.NewState()
+
+	amiState := terraform.NewState()
+	amiState.RootModule().Resources["aws_ami_from_instance.result"] = &terraform.ResourceState{
+		Type: "aws_ami_from_instance",
+		Primary: &terraform.InstanceState{
+			ID: "ami-12345",
+		},
+	}
+	SetTargetState(state, "ami", amiState)
+
+	instanceState := terraform.NewState()
+	instanceState.AddModule([]string{"root", "build_support"})
+	instanceState.RootModule().Resources["aws_instance.result"] = &terraform.ResourceState{
+		Type: "aws_instance",
+		Primary: &terraform.InstanceState{
+			ID: "i-12345",
+		},
+	}
+	SetTargetState(state, "ami_source_instance", instanceState)
+
+	if got, want := StateTargetNames(state), []string{"ami", "ami_source_instance"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got target names %#v; want %#v", got, want)
+	}
+	if state.ModuleByPath([]string{"root", "ami_source_instance", "build_support"}) == nil {
+		t.Fatalf("result state has no module for ami_source_instance's build_support module")
+	}
+
+	got := TargetState(state, "ami_source_instance")
+	if got.ModuleByPath([]string{"root", "build_support"}) == nil {
+		t.Fatalf("extracted state has no module for build_support")
+	}
+	if got, want := got.RootModule().Resources["aws_instance.result"].Primary.ID, "i-12345"; got != want {
+		t.Fatalf("extracted state has instance id %q; want %q", got, want)
+	}
+
+	RemoveTargetState(state, "ami_source_instance")
+	if got, want := StateTargetNames(state), []string{"ami"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("after removal got target names %#v; want %#v", got, want)
+	}
+	if state.ModuleByPath(rootModulePath) == nil {
+		t.Fatalf("root module was removed")
+	}
+
+	if got := TargetState(state, "nonexist"); got.HasResources() {
+		t.Fatalf("state for nonexistent target is not empty")
+	}
+}
+
+func TestStateResources(t *testing.T) {
+	state := terraform.NewState()
+
+	instanceState := terraform.NewState()
+	instanceState.RootModule().Resources["aws_instance.result"] = &terraform.ResourceState{
+		Type: "aws_instance",
+		Primary: &terraform.InstanceState{
+			ID: "i-12345",
+		},
+	}
+	support := instanceState.AddModule([]string{"root", "build_support"})
+	support.Resources["aws_security_group.ssh"] = &terraform.ResourceState{
+		Type: "aws_security_group",
+		Primary: &terraform.InstanceState{
+			ID: "sg-12345",
+		},
+	}
+	SetTargetState(state, "ami_source_instance", instanceState)
+
+	got := StateResources(state)
+	want := []StateResource{
+		{"ami_source_instance", "aws_instance.result", "i-12345"},
+		{"ami_source_instance", "module.build_support.aws_security_group.ssh", "sg-12345"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got resources %#v; want %#v", got, want)
+	}
+}
@@ -0,0 +1,654 @@
+package padstone
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	tfcfg "github.com/hashicorp/terraform/config"
+)
+
+// TargetOutputRef is a reference from within one target to an output of
+// another target, written in the configuration as "target.NAME.OUTPUT".
+type TargetOutputRef struct {
+	Target string
+	Output string
+}
+
+func (r TargetOutputRef) String() string {
+	return fmt.Sprintf("target.%s.%s", r.Target, r.Output)
+}
+
+// VariableName returns the name of the variable that is used to pass the
+// referenced output into the Terraform configuration of the referring
+// target.
+func (r TargetOutputRef) VariableName() string {
+	return fmt.Sprintf("target__%s__%s", r.Target, r.Output)
+}
+
+// TargetGraph describes the dependencies between the targets of a
+// configuration, which arise from references to the outputs of other
+// targets.
+//
+// A TargetGraph is always acyclic; Config.TargetGraph returns an error if
+// the targets depend on each other in a cycle.
+type TargetGraph struct {
+	config       *Config
+	dependencies map[string][]string
+	dependents   map[string][]string
+}
+
+// TargetGraph builds the dependency graph of the targets in the receiving
+// configuration.
+func (c *Config) TargetGraph() (*TargetGraph, error) {
+	g := &TargetGraph{
+		config:       c,
+		dependencies: make(map[string][]string),
+		dependents:   make(map[string][]string),
+	}
+
+	var diags Diagnostics
+	for _, target := range c.Targets {
+		if _, exists := g.dependencies[target.Name]; exists {
+			diags = append(diags, &Diagnostic{
+				Severity: DiagnosticError,
+				Message:  fmt.Sprintf("target %s is declared more than once", target.Name),
+				Filename: c.SourceFilename,
+				Target:   target.Name,
+			})
+			continue
+		}
+		g.dependencies[target.Name] = []string{}
+	}
+	if diags.HasErrors() {
+		return nil, diags
+	}
+
+	for _, target := range c.Targets {
+		if errs := target.checkTargetRefs(); len(errs) > 0 {
+			return nil, fmt.Errorf("target %s: %s", target.Name, errs[0])
+		}
+
+		for _, depName := range target.Dependencies() {
+			if _, exists := g.dependencies[depName]; !exists {
+				return nil, fmt.Errorf(
+					"target %s refers to undeclared target %s", target.Name, depName,
+				)
+			}
+
+			g.dependencies[target.Name] = append(g.dependencies[target.Name], depName)
+			g.dependents[depName] = append(g.dependents[depName], target.Name)
+		}
+	}
+
+	if cycle := g.findCycle(); cycle != nil {
+		return nil, fmt.Errorf(
+			"targets have a dependency cycle: %s", strings.Join(cycle, " -> "),
+		)
+	}
+
+	return g, nil
+}
+
+// Dependencies returns the names of the targets that the given target
+// directly depends on.
+func (g *TargetGraph) Dependencies(name string) []string {
+	return g.dependencies[name]
+}
+
+// Dependents returns the names of the targets that directly depend on the
+// given target.
+func (g *TargetGraph) Dependents(name string) []string {
+	return g.dependents[name]
+}
+
+// Order returns the names of all of the targets in an order where each
+// target appears after all of its dependencies. Targets that do not depend
+// on one another retain the order in which they were declared.
+//
+// Config.TargetGraph ensures that such an order exists, but Order returns
+// an error rather than looping forever if the configuration has since been
+// changed so that it does not.
+func (g *TargetGraph) Order() ([]string, error) {
+	ret := make([]string, 0, len(g.config.Targets))
+	done := make(map[string]bool)
+
+	for len(ret) < len(g.config.Targets) {
+		placed := len(ret)
+
+		for _, target := range g.config.Targets {
+			if done[target.Name] {
+				continue
+			}
+
+			ready := true
+			for _, depName := range g.dependencies[target.Name] {
+				if !done[depName] {
+					ready = false
+					break
+				}
+			}
+			if !ready {
+				continue
+			}
+
+			ret = append(ret, target.Name)
+			done[target.Name] = true
+			break
+		}
+
+		if len(ret) == placed {
+			placedCount := make(map[string]int, len(ret))
+			for _, name := range ret {
+				placedCount[name]++
+			}
+			var remaining []string
+			for _, target := range g.config.Targets {
+				if placedCount[target.Name] > 0 {
+					placedCount[target.Name]--
+					continue
+				}
+				remaining = append(remaining, target.Name)
+			}
+			return nil, fmt.Errorf(
+				"targets %s cannot be ordered, because their dependencies cannot be satisfied or they are declared more than once",
+				strings.Join(remaining, ", "),
+			)
+		}
+	}
+
+	return ret, nil
+}
+
+// findCycle returns the names of the targets that form a dependency
+// cycle, with the first target repeated at the end, or nil if the graph
+// is acyclic.
+func (g *TargetGraph) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int)
+	var stack []string
+	var visit func(name string) []string
+
+	visit = func(name string) []string {
+		state[name] = visiting
+		stack = append(stack, name)
+
+		for _, depName := range g.dependencies[name] {
+			switch state[depName] {
+			case visiting:
+				for i, stackName := range stack {
+					if stackName == depName {
+						cycle := append([]string{}, stack[i:]...)
+						return append(cycle, depName)
+					}
+				}
+			case unvisited:
+				if cycle := visit(depName); cycle != nil {
+					return cycle
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, target := range g.config.Targets {
+		if state[target.Name] != unvisited {
+			continue
+		}
+		if cycle := visit(target.Name); cycle != nil {
+			return cycle
+		}
+	}
+
+	return nil
+}
+
+// TargetOutputRefs returns all of the distinct references the target
+// makes to the outputs of other targets.
+func (t *TargetConfig) TargetOutputRefs() []TargetOutputRef {
+	seen := map[TargetOutputRef]bool{}
+	var ret []TargetOutputRef
+
+	for _, rawConfig := range t.rawConfigs() {
+		if rawConfig == nil {
+			continue
+		}
+		for _, v := range rawConfig.Variables {
+			rv, ok := v.(*tfcfg.ResourceVariable)
+			if !ok || !isTargetRef(rv) || checkTargetRef(rv) != nil {
+				continue
+			}
+
+			ref := TargetOutputRef{
+				Target: rv.Name,
+				Output: rv.Field,
+			}
+			if seen[ref] {
+				continue
+			}
+			seen[ref] = true
+			ret = append(ret, ref)
+		}
+	}
+
+	sort.Sort(targetOutputRefs(ret))
+	return ret
+}
+
+// checkTargetRefs returns an error for each reference in the target to
+// another target that is not of the form "target.NAME.OUTPUT", such as
+// "target.*.id" or "target.a.*". Such references are not rewritten for
+// Terraform, and are not included in TargetOutputRefs.
+func (t *TargetConfig) checkTargetRefs() []error {
+	var ret []error
+
+	for _, rawConfig := range t.rawConfigs() {
+		if rawConfig == nil {
+			continue
+		}
+
+		keys := make([]string, 0, len(rawConfig.Variables))
+		for k := range rawConfig.Variables {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			rv, ok := rawConfig.Variables[k].(*tfcfg.ResourceVariable)
+			if !ok || !isTargetRef(rv) {
+				continue
+			}
+			if err := checkTargetRef(rv); err != nil {
+				ret = append(ret, err)
+			}
+		}
+	}
+
+	return ret
+}
+
+// isTargetRef returns true if the given variable is a reference to
+// another target, which Terraform parses as a reference to a resource of
+// type "target".
+func isTargetRef(rv *tfcfg.ResourceVariable) bool {
+	return rv.Mode == tfcfg.ManagedResourceMode && rv.Type == "target"
+}
+
+// targetRefNamePattern matches the target and output names that may appear
+// in a reference to a target output. It must agree with targetRefPattern.
+var targetRefNamePattern = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+// checkTargetRef returns an error if the given reference to another target
+// is not of the form "target.NAME.OUTPUT".
+func checkTargetRef(rv *tfcfg.ResourceVariable) error {
+	if rv.Multi || !targetRefNamePattern.MatchString(rv.Name) || !targetRefNamePattern.MatchString(rv.Field) {
+		return fmt.Errorf(
+			"invalid reference %s: a target output must be referred to as target.NAME.OUTPUT, without wildcards or indexes",
+			rv.FullKey(),
+		)
+	}
+	return nil
+}
+
+// Dependencies returns the names of the other targets that the target
+// refers to.
+func (t *TargetConfig) Dependencies() []string {
+	seen := map[string]bool{}
+	var ret []string
+
+	for _, ref := range t.TargetOutputRefs() {
+		if seen[ref.Target] {
+			continue
+		}
+		seen[ref.Target] = true
+		ret = append(ret, ref.Target)
+	}
+
+	return ret
+}
+
+// UpstreamVariables returns the variable values that satisfy the target's
+// references to the outputs of other targets, given a map from target name
+// to the outputs that each target produced.
+//
+// An output that is referenced but not present in the given map is an
+// error, since the target cannot be built without it.
+func (t *TargetConfig) UpstreamVariables(outputs map[string]map[string]interface{}) (map[string]interface{}, error) {
+	ret := make(map[string]interface{})
+
+	for _, ref := range t.TargetOutputRefs() {
+		targetOutputs, exists := outputs[ref.Target]
+		if !exists {
+			return nil, fmt.Errorf(
+				"target %s refers to target %s, which has not been built", t.Name, ref.Target,
+			)
+		}
+
+		value, exists := targetOutputs[ref.Output]
+		if !exists {
+			return nil, fmt.Errorf(
+				"target %s refers to %s, but target %s has no such output", t.Name, ref, ref.Target,
+			)
+		}
+
+		ret[ref.VariableName()] = value
+	}
+
+	return ret, nil
+}
+
+// rawConfigs returns all of the raw configurations within the target that
+// might contain interpolations.
+func (t *TargetConfig) rawConfigs() []*tfcfg.RawConfig {
+	var ret []*tfcfg.RawConfig
+
+	for _, provider := range t.Providers {
+		ret = append(ret, provider.RawConfig)
+	}
+	for _, module := range t.Modules {
+		ret = append(ret, module.RawConfig)
+	}
+	for _, resource := range t.Resources {
+		ret = append(ret, resource.RawCount, resource.RawConfig)
+		for _, provisioner := range resource.Provisioners {
+			ret = append(ret, provisioner.RawConfig, provisioner.ConnInfo)
+		}
+	}
+	for _, output := range t.Outputs {
+		ret = append(ret, output.RawConfig)
+	}
+
+	return ret
+}
+
+type targetOutputRefs []TargetOutputRef
+
+func (s targetOutputRefs) Len() int {
+	return len(s)
+}
+
+func (s targetOutputRefs) Less(i, j int) bool {
+	if s[i].Target != s[j].Target {
+		return s[i].Target < s[j].Target
+	}
+	return s[i].Output < s[j].Output
+}
+
+func (s targetOutputRefs) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Terraform itself doesn't know about targets, so before we hand a
+// target's configuration to Terraform we rewrite each "target.NAME.OUTPUT"
+// reference into a reference to a variable, whose value is then populated
+// from the outputs of the upstream target.
+var targetRefPattern = regexp.MustCompile(
+	`(^|[^A-Za-z0-9_.\-])target\.([A-Za-z0-9_\-]+)\.([A-Za-z0-9_\-]+)`,
+)
+
+func rewriteTargetRefs(rawConfig *tfcfg.RawConfig) (*tfcfg.RawConfig, error) {
+	if rawConfig == nil {
+		return nil, nil
+	}
+
+	raw := rewriteTargetRefsValue(rawConfig.Raw).(map[string]interface{})
+	ret, err := tfcfg.NewRawConfig(raw)
+	if err != nil {
+		return nil, err
+	}
+	ret.Key = rawConfig.Key
+
+	return ret, nil
+}
+
+func rewriteTargetRefsValue(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case string:
+		return rewriteTargetRefsString(tv)
+	case map[string]interface{}:
+		ret := make(map[string]interface{}, len(tv))
+		for k, ev := range tv {
+			ret[k] = rewriteTargetRefsValue(ev)
+		}
+		return ret
+	case []map[string]interface{}:
+		ret := make([]map[string]interface{}, len(tv))
+		for i, ev := range tv {
+			ret[i] = rewriteTargetRefsValue(ev).(map[string]interface{})
+		}
+		return ret
+	case []interface{}:
+		ret := make([]interface{}, len(tv))
+		for i, ev := range tv {
+			ret[i] = rewriteTargetRefsValue(ev)
+		}
+		return ret
+	default:
+		return v
+	}
+}
+
+func rewriteTargetRefsString(s string) string {
+	var buf bytes.Buffer
+
+	for {
+		start := strings.Index(s, "${")
+		if start == -1 {
+			buf.WriteString(s)
+			break
+		}
+
+		// "$${" is an escaped literal "${", not an interpolation.
+		if start > 0 && s[start-1] == '$' {
+			buf.WriteString(s[:start+2])
+			s = s[start+2:]
+			continue
+		}
+
+		end := start + 2
+		for depth := 1; end < len(s); end++ {
+			if s[end] == '{' {
+				depth++
+			} else if s[end] == '}' {
+				depth--
+				if depth == 0 {
+					break
+				}
+			}
+		}
+
+		buf.WriteString(s[:start+2])
+		buf.WriteString(targetRefPattern.ReplaceAllStringFunc(s[start+2:end], func(match string) string {
+			sub := targetRefPattern.FindStringSubmatch(match)
+			ref := TargetOutputRef{
+				Target: sub[2],
+				Output: sub[3],
+			}
+			return sub[1] + "var." + ref.VariableName()
+		}))
+
+		s = s[end:]
+	}
+
+	return buf.String()
+}
+
+// rewriteTargetConfig returns a copy of the given Terraform configuration
+// with all of its references to target outputs replaced with references to
+// variables, and with those variables declared.
+func rewriteTargetConfig(config *tfcfg.Config, refs []TargetOutputRef) (*tfcfg.Config, error) {
+	ret := &tfcfg.Config{
+		Dir:             config.Dir,
+		Variables:       make([]*tfcfg.Variable, 0, len(config.Variables)+len(refs)),
+		Modules:         make([]*tfcfg.Module, 0, len(config.Modules)),
+		Resources:       make([]*tfcfg.Resource, 0, len(config.Resources)),
+		Outputs:         make([]*tfcfg.Output, 0, len(config.Outputs)),
+		ProviderConfigs: make([]*tfcfg.ProviderConfig, 0, len(config.ProviderConfigs)),
+	}
+
+	ret.Variables = append(ret.Variables, config.Variables...)
+	for _, ref := range refs {
+		ret.Variables = append(ret.Variables, &tfcfg.Variable{
+			Name:        ref.VariableName(),
+			Description: fmt.Sprintf("value of %s", ref),
+		})
+	}
+
+	var err error
+
+	for _, provider := range config.ProviderConfigs {
+		newProvider := *provider
+		newProvider.RawConfig, err = rewriteTargetRefs(provider.RawConfig)
+		if err != nil {
+			return nil, fmt.Errorf("provider %s: %s", provider.FullName(), err)
+		}
+		ret.ProviderConfigs = append(ret.ProviderConfigs, &newProvider)
+	}
+
+	for _, module := range config.Modules {
+		newModule := *module
+		newModule.RawConfig, err = rewriteTargetRefs(module.RawConfig)
+		if err != nil {
+			return nil, fmt.Errorf("module %s: %s", module.Name, err)
+		}
+		ret.Modules = append(ret.Modules, &newModule)
+	}
+
+	for _, resource := range config.Resources {
+		newResource := *resource
+		newResource.RawCount, err = rewriteTargetRefs(resource.RawCount)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", resource.Id(), err)
+		}
+		newResource.RawConfig, err = rewriteTargetRefs(resource.RawConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", resource.Id(), err)
+		}
+
+		newResource.Provisioners = make([]*tfcfg.Provisioner, 0, len(resource.Provisioners))
+		for _, provisioner := range resource.Provisioners {
+			newProvisioner := *provisioner
+			newProvisioner.RawConfig, err = rewriteTargetRefs(provisioner.RawConfig)
+			if err != nil {
+				return nil, fmt.Errorf("%s provisioner %s: %s", resource.Id(), provisioner.Type, err)
+			}
+			newProvisioner.ConnInfo, err = rewriteTargetRefs(provisioner.ConnInfo)
+			if err != nil {
+				return nil, fmt.Errorf("%s provisioner %s: %s", resource.Id(), provisioner.Type, err)
+			}
+			newResource.Provisioners = append(newResource.Provisioners, &newProvisioner)
+		}
+
+		ret.Resources = append(ret.Resources, &newResource)
+	}
+
+	for _, output := range config.Outputs {
+		newOutput := *output
+		newOutput.RawConfig, err = rewriteTargetRefs(output.RawConfig)
+		if err != nil {
+			return nil, fmt.Errorf("output %s: %s", output.Name, err)
+		}
+		ret.Outputs = append(ret.Outputs, &newOutput)
+	}
+
+	return ret, nil
+}
+
+// TargetSelection describes the targets that must be built in order to
+// produce a particular set of kept targets.
+//
+// Any target that is built only because a kept target depends on it is
+// temporary: it is destroyed once the build is complete, and so does not
+// appear in the final state.
+type TargetSelection struct {
+	// Order is the names of all of the targets to be built, in the order
+	// they must be built.
+	Order []string
+
+	// Kept is the names of the targets whose resources will remain once
+	// the build is complete, in build order.
+	Kept []string
+
+	// Temporary is the names of the targets that will be destroyed once
+	// the build is complete, in build order.
+	Temporary []string
+}
+
+// Select returns a TargetSelection that keeps the targets with the given
+// names, building their dependencies as temporary targets.
+func (g *TargetGraph) Select(names []string) (*TargetSelection, error) {
+	keep := make(map[string]bool, len(names))
+	needed := make(map[string]bool)
+
+	var visit func(name string)
+	visit = func(name string) {
+		if needed[name] {
+			return
+		}
+		needed[name] = true
+		for _, depName := range g.dependencies[name] {
+			visit(depName)
+		}
+	}
+
+	for _, name := range names {
+		if _, exists := g.dependencies[name]; !exists {
+			return nil, fmt.Errorf("there is no target named %s", name)
+		}
+		keep[name] = true
+		visit(name)
+	}
+
+	order, err := g.Order()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &TargetSelection{}
+	for _, name := range order {
+		if !needed[name] {
+			continue
+		}
+
+		ret.Order = append(ret.Order, name)
+		if keep[name] {
+			ret.Kept = append(ret.Kept, name)
+		} else {
+			ret.Temporary = append(ret.Temporary, name)
+		}
+	}
+
+	return ret, nil
+}
+
+// IsTemporary returns true if the target with the given name will be
+// destroyed once the build is complete.
+func (s *TargetSelection) IsTemporary(name string) bool {
+	for _, tempName := range s.Temporary {
+		if tempName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanUpOrder returns the names of the temporary targets in the order
+// they must be destroyed, which is the reverse of the order they were
+// built.
+func (s *TargetSelection) CleanUpOrder() []string {
+	ret := make([]string, len(s.Temporary))
+	for i, name := range s.Temporary {
+		ret[len(ret)-1-i] = name
+	}
+	return ret
+}
@@ -0,0 +1,264 @@
+package padstone
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	tfcfg "github.com/hashicorp/terraform/config"
+)
+
+func TestTargetGraph(t *testing.T) {
+	config, err := ParseConfig([]byte(configTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	graph, err := config.TargetGraph()
+	if err != nil {
+		t.Fatalf("unexpected error building target graph: %s", err)
+	}
+
+	order, err := graph.Order()
+	if err != nil {
+		t.Fatalf("unexpected error ordering targets: %s", err)
+	}
+	if got, want := order, []string{"ami_source_instance", "ami", "dev"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got order %#v; want %#v", got, want)
+	}
+	if got, want := graph.Dependencies("ami"), []string{"ami_source_instance"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got ami dependencies %#v; want %#v", got, want)
+	}
+	if got, want := graph.Dependents("ami_source_instance"), []string{"ami"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got ami_source_instance dependents %#v; want %#v", got, want)
+	}
+	if got := graph.Dependencies("dev"); len(got) != 0 {
+		t.Fatalf("got dev dependencies %#v; want none", got)
+	}
+}
+
+func TestTargetGraphCycle(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+target "a" {
+  output "x" {
+    value = "${target.c.x}"
+  }
+}
+target "b" {
+  output "x" {
+    value = "${target.a.x}"
+  }
+}
+target "c" {
+  output "x" {
+    value = "${target.b.x}"
+  }
+}
+`), "cycle.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	_, err = config.TargetGraph()
+	if err == nil {
+		t.Fatalf("succeeded; want cycle error")
+	}
+	if got, want := err.Error(), "a -> c -> b -> a"; !strings.Contains(got, want) {
+		t.Fatalf("got error %q; want it to mention %q", got, want)
+	}
+}
+
+func TestTargetGraphDuplicate(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+target "a" {
+  output "x" {
+    value = "a"
+  }
+}
+target "b" {
+  output "x" {
+    value = "${target.a.x}"
+  }
+}
+target "a" {
+  output "y" {
+    value = "a"
+  }
+}
+`), "duplicate.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	_, err = config.TargetGraph()
+	if err == nil {
+		t.Fatalf("succeeded; want duplicate target error")
+	}
+	if got, want := err.Error(), "duplicate.hcl: target a: target a is declared more than once"; got != want {
+		t.Fatalf("got error %q; want %q", got, want)
+	}
+
+	// A graph whose configuration gains a duplicate after it is built
+	// cannot be ordered, but must not loop forever trying.
+	config.Targets = config.Targets[:2]
+	graph, err := config.TargetGraph()
+	if err != nil {
+		t.Fatalf("unexpected error building target graph: %s", err)
+	}
+	config.Targets = append(config.Targets, &TargetConfig{Name: "a"})
+	_, err = graph.Order()
+	if err == nil {
+		t.Fatalf("succeeded; want ordering error")
+	}
+	if got, want := err.Error(), "targets a cannot be ordered"; !strings.Contains(got, want) {
+		t.Fatalf("got error %q; want it to mention %q", got, want)
+	}
+}
+
+func TestTargetRefsInvalid(t *testing.T) {
+	for _, ref := range []string{"target.*.x", "target.a.*", "target.a.*.x", "target.a.0.x"} {
+		_, err := ParseConfig([]byte(`
+target "a" {
+  output "x" {
+    value = "a"
+  }
+}
+target "b" {
+  output "x" {
+    value = "${`+ref+`}"
+  }
+}
+`), "refs.hcl")
+		if err == nil {
+			t.Fatalf("%s: succeeded; want invalid reference error", ref)
+		}
+		want := "refs.hcl:7:8: target b: invalid reference " + ref + ": a target output must be referred to as target.NAME.OUTPUT"
+		if got := err.Error(); !strings.HasPrefix(got, want) {
+			t.Fatalf("%s: got error %q; want %q", ref, got, want)
+		}
+	}
+
+	config := &Config{
+		Targets: []*TargetConfig{
+			{
+				Name: "b",
+				Outputs: []*tfcfg.Output{
+					{
+						Name:      "x",
+						RawConfig: mustRawConfig(t, map[string]interface{}{"value": "${target.*.x}"}),
+					},
+				},
+			},
+		},
+	}
+	if _, err := config.TargetModuleTrees(); err == nil {
+		t.Fatalf("TargetModuleTrees succeeded; want invalid reference error")
+	}
+	if _, err := config.TargetGraph(); err == nil {
+		t.Fatalf("TargetGraph succeeded; want invalid reference error")
+	}
+}
+
+func mustRawConfig(t *testing.T, raw map[string]interface{}) *tfcfg.RawConfig {
+	rawConfig, err := tfcfg.NewRawConfig(raw)
+	if err != nil {
+		t.Fatalf("unexpected error building raw config: %s", err)
+	}
+	return rawConfig
+}
+
+func TestConfigTargetModuleTrees(t *testing.T) {
+	config, err := ParseConfig([]byte(configTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	trees, err := config.TargetModuleTrees()
+	if err != nil {
+		t.Fatalf("unexpected error building module trees: %s", err)
+	}
+
+	if got, want := len(trees), 3; got != want {
+		t.Fatalf("got %d module trees; want %d", got, want)
+	}
+
+	amiConfig := trees["ami"].Config()
+
+	var found bool
+	for _, variable := range amiConfig.Variables {
+		if variable.Name == "target__ami_source_instance__id" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("ami config does not declare a variable for target.ami_source_instance.id")
+	}
+
+	if got, want := amiConfig.Resources[0].RawConfig.Raw["instance_id"], "${var.target__ami_source_instance__id}"; got != want {
+		t.Fatalf("ami resource 0 instance_id %q; want %q", got, want)
+	}
+
+	// The original configuration must be left untouched.
+	if got, want := config.Targets[0].Resources[0].RawConfig.Raw["instance_id"], "${target.ami_source_instance.id}"; got != want {
+		t.Fatalf("original ami resource 0 instance_id %q; want %q", got, want)
+	}
+
+	vars, err := config.Targets[0].UpstreamVariables(map[string]map[string]interface{}{
+		"ami_source_instance": {
+			"id": "i-12345",
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error getting upstream variables: %s", err)
+	}
+	if got, want := vars, map[string]interface{}{"target__ami_source_instance__id": "i-12345"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got upstream variables %#v; want %#v", got, want)
+	}
+}
+
+func TestTargetGraphSelect(t *testing.T) {
+	config, err := ParseConfig([]byte(configTestConfig), "padstone.hcl")
+	if err != nil {
+		t.Fatalf("unexpected error parsing config: %s", err)
+	}
+
+	graph, err := config.TargetGraph()
+	if err != nil {
+		t.Fatalf("unexpected error building target graph: %s", err)
+	}
+
+	sel, err := graph.Select([]string{"ami"})
+	if err != nil {
+		t.Fatalf("unexpected error selecting targets: %s", err)
+	}
+
+	if got, want := sel.Order, []string{"ami_source_instance", "ami"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got order %#v; want %#v", got, want)
+	}
+	if got, want := sel.Kept, []string{"ami"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got kept %#v; want %#v", got, want)
+	}
+	if got, want := sel.Temporary, []string{"ami_source_instance"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got temporary %#v; want %#v", got, want)
+	}
+	if !sel.IsTemporary("ami_source_instance") {
+		t.Fatalf("ami_source_instance is not temporary; should be")
+	}
+	if sel.IsTemporary("ami") {
+		t.Fatalf("ami is temporary; should not be")
+	}
+
+	// Selecting a dependency explicitly keeps it.
+	sel, err = graph.Select([]string{"ami", "ami_source_instance"})
+	if err != nil {
+		t.Fatalf("unexpected error selecting targets: %s", err)
+	}
+	if got := sel.Temporary; len(got) != 0 {
+		t.Fatalf("got temporary %#v; want none", got)
+	}
+
+	_, err = graph.Select([]string{"nonexist"})
+	if err == nil {
+		t.Fatalf("selecting nonexistent target succeeded; want error")
+	}
+}
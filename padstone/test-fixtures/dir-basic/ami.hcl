@@ -0,0 +1,20 @@
+target "ami" {
+  resource "aws_ami_from_instance" "result" {
+    instance_id = "${target.ami_source_instance.id}"
+  }
+
+  output "id" {
+    value = "${aws_ami_from_instance.result.id}"
+  }
+}
+
+target "ami_source_instance" {
+  resource "aws_instance" "result" {
+    ami           = "ami-06b94666"
+    instance_type = "m3.medium"
+  }
+
+  output "id" {
+    value = "${aws_instance.result.id}"
+  }
+}
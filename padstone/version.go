@@ -0,0 +1,5 @@
+package padstone
+
+// Version is the version of Padstone, which is recorded in the metadata of
+// each build.
+var Version = "0.1.0-dev"